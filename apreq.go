@@ -0,0 +1,154 @@
+package main
+
+// Kerberos AP-REQ module
+//
+// CLI clients obtain token via POST /oauth/authorize end-point. Instead of
+// sending their credentials cache, clients should send GSSAPI AP-REQ token
+// for Authz service principal (HTTP/<authz host>) in APReq field, e.g.
+//
+// {"User": "user", "Scope": "read", "Expires": 3600, "APReq": "<base64 token>"}
+//
+// The AP-REQ is validated against Authz keytab (Kerberos.Keytab), i.e. the
+// service ticket must be issued by KDC for Authz principal, and its
+// authenticator must be within allowed clock skew (Authz.KerberosClockSkew)
+// and must not be seen before. Authenticators are kept in kerberos_replays
+// table shared by Authz replicas. Go clients may use KerberosAPReq function to
+// build the token. Credentials cache sent by old clients in Ticket field is
+// not verified by KDC and therefore rejected, such clients should upload
+// their ccache to POST /oauth/ccache end-point (see ccache module).
+//
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	authz "github.com/CHESSComputing/golib/authz"
+	"gopkg.in/jcmturner/gokrb5.v7/client"
+	"gopkg.in/jcmturner/gokrb5.v7/credentials"
+	"gopkg.in/jcmturner/gokrb5.v7/messages"
+	"gopkg.in/jcmturner/gokrb5.v7/spnego"
+	"gopkg.in/jcmturner/gokrb5.v7/types"
+)
+
+// kerberosClockSkew defines default allowed clock skew of Kerberos authenticators in seconds
+const kerberosClockSkew = 300
+
+// errKerberosReplay is returned when AP-REQ authenticator is replayed
+var errKerberosReplay = errors.New("kerberos authenticator is already used")
+
+// KerberosRequest represents request of CLI clients to POST /oauth/authorize
+// end-point, it extends golib authz.Kerberos with AP-REQ
+type KerberosRequest struct {
+	authz.Kerberos
+	APReq []byte // GSSAPI AP-REQ token for Authz service principal
+}
+
+// KerberosAPReq provides GSSAPI AP-REQ token of Kerberos client for given
+// service principal, e.g. HTTP/foxden.classe.cornell.edu
+func KerberosAPReq(cl *client.Client, spn string) ([]byte, error) {
+	tkt, key, err := cl.GetServiceTicket(spn)
+	if err != nil {
+		return nil, fmt.Errorf("[Authz.main.KerberosAPReq] cl.GetServiceTicket error: %w", err)
+	}
+	token, err := spnego.NewKRB5TokenAPREQ(cl, tkt, key, []int{}, []int{})
+	if err != nil {
+		return nil, fmt.Errorf("[Authz.main.KerberosAPReq] spnego.NewKRB5TokenAPREQ error: %w", err)
+	}
+	return token.Marshal()
+}
+
+// helper function to return allowed clock skew of Kerberos authenticators
+func clockSkew() time.Duration {
+	if _config.KerberosClockSkew > 0 {
+		return time.Duration(_config.KerberosClockSkew) * time.Second
+	}
+	return kerberosClockSkew * time.Second
+}
+
+// helper function to decode AP-REQ, it accepts GSSAPI KRB5 token as well as
+// bare Kerberos AP-REQ message
+func decodeAPReq(data []byte) (messages.APReq, error) {
+	var token spnego.KRB5Token
+	if err := token.Unmarshal(data); err == nil {
+		if !token.IsAPReq() {
+			return token.APReq, errors.New("kerberos token is not AP-REQ")
+		}
+		return token.APReq, nil
+	}
+	var apReq messages.APReq
+	if err := apReq.Unmarshal(data); err != nil {
+		return apReq, fmt.Errorf("[Authz.main.decodeAPReq] apReq.Unmarshal error: %w", err)
+	}
+	return apReq, nil
+}
+
+// helper function to validate AP-REQ of given request against Authz keytab,
+// it returns credentials of authenticated user
+func verifyAPReq(r *http.Request, data []byte) (*credentials.Credentials, error) {
+	if _keytab == nil {
+		return nil, errors.New("kerberos keytab of Authz service is not configured")
+	}
+	apReq, err := decodeAPReq(data)
+	if err != nil {
+		return nil, err
+	}
+	// verify ticket with Authz key, its validity, client address, and
+	// authenticator clock skew
+	var addr types.HostAddress
+	if ip := net.ParseIP(getIP(r)); ip != nil {
+		addr = types.HostAddressFromNetIP(ip)
+	}
+	ok, err := apReq.Verify(_keytab, clockSkew(), addr)
+	if err != nil {
+		return nil, fmt.Errorf("[Authz.main.verifyAPReq] apReq.Verify error: %w", err)
+	}
+	if !ok {
+		return nil, errors.New("invalid kerberos AP-REQ")
+	}
+	auth := apReq.Authenticator
+	if _, err := findRealm(auth.CRealm); err != nil {
+		return nil, err
+	}
+	// authenticators are recorded in table shared by Authz replicas
+	key := fmt.Sprintf("%s@%s/%s/%d.%d", auth.CName.PrincipalNameString(), auth.CRealm,
+		apReq.Ticket.SName.PrincipalNameString(), auth.CTime.Unix(), auth.Cusec)
+	expires := auth.CTime.Add(clockSkew()).Unix()
+	if err := addKerberosReplay(_DB, key, expires); err != nil {
+		return nil, err
+	}
+	creds := credentials.NewFromPrincipalName(auth.CName, auth.CRealm)
+	creds.SetAuthTime(time.Now().UTC())
+	creds.SetAuthenticated(true)
+	creds.SetValidUntil(apReq.Ticket.DecryptedEncPart.EndTime)
+	return creds, nil
+}
+
+// helper function to record authenticator of AP-REQ, it returns
+// errKerberosReplay if authenticator is already used
+func addKerberosReplay(db *sql.DB, authenticator string, expires int64) error {
+	err := addReplayKey(db, "kerberos_replays", "authenticator", authenticator, expires)
+	if errors.Is(err, errReplayKey) {
+		return errKerberosReplay
+	}
+	return err
+}
+
+// helper function to obtain credentials of Kerberos request, only AP-REQ
+// validated against Authz keytab is accepted
+func kerberosCredentials(r *http.Request, rec *KerberosRequest) (*credentials.Credentials, error) {
+	if len(rec.APReq) == 0 {
+		return nil, errors.New("kerberos AP-REQ is required, credentials cache should be sent to /oauth/ccache end-point")
+	}
+	return verifyAPReq(r, rec.APReq)
+}
+
+// helper function to remove expired authenticators of AP-REQs
+func cleanupKerberosReplays(db *sql.DB) error {
+	if _, err := db.Exec("DELETE FROM kerberos_replays WHERE expires < ?", time.Now().Unix()); err != nil {
+		return fmt.Errorf("[Authz.main.cleanupKerberosReplays] db.Exec error: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+// token audience module
+//
+// Tokens may be restricted to specific FOXDEN services via aud claim. The
+// audience is requested via audience or resource (RFC 8707) parameters and
+// it should be allowed for OAuth client which requests the token. Clients
+// with allowed audiences always obtain audience restricted tokens.
+//
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	authz "github.com/CHESSComputing/golib/authz"
+	utils "github.com/CHESSComputing/golib/utils"
+)
+
+// authzAudience defines audience of Authz service itself
+const authzAudience = "Authz"
+
+// helper function to get requested audience of HTTP request, the audience
+// can be provided either via audience or resource parameters
+func requestAudience(r *http.Request) []string {
+	r.ParseForm()
+	var audience []string
+	for _, key := range []string{"audience", "resource"} {
+		for _, val := range r.Form[key] {
+			for _, aud := range strings.Fields(val) {
+				if !utils.InList(aud, audience) {
+					audience = append(audience, aud)
+				}
+			}
+		}
+	}
+	return audience
+}
+
+// AllowedAudience checks if client is allowed to request token for given audience
+func (c *Client) AllowedAudience(audience string) bool {
+	return len(c.Audiences) == 0 || utils.InList(audience, c.Audiences)
+}
+
+// helper function to resolve token audience for given client and requested
+// audience, if audience is not requested we use all allowed client audiences
+func clientAudience(client *Client, audience []string) ([]string, error) {
+	if len(audience) == 0 {
+		return client.Audiences, nil
+	}
+	for _, aud := range audience {
+		if !client.AllowedAudience(aud) {
+			return nil, fmt.Errorf("audience %s is not allowed for client %s", aud, client.ID)
+		}
+	}
+	return audience, nil
+}
+
+// helper function to check that requested audience is subset of granted one
+func narrowAudience(audience, granted []string) ([]string, error) {
+	if len(audience) == 0 {
+		return granted, nil
+	}
+	if len(granted) == 0 {
+		return audience, nil
+	}
+	for _, aud := range audience {
+		if !utils.InList(aud, granted) {
+			return nil, fmt.Errorf("audience %s was not granted", aud)
+		}
+	}
+	return audience, nil
+}
+
+// helper function to check if token is intended for given service, tokens
+// without audience are accepted by all services
+func validAudience(claims *authz.Claims, service string) bool {
+	return len(claims.Audience) == 0 || utils.InList(service, claims.Audience)
+}
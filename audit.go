@@ -0,0 +1,344 @@
+package main
+
+// audit module
+//
+// Every authentication decision (token issuance or denial, Kerberos login,
+// trusted client check) is recorded in append-only audit_log table. Records
+// are hash-chained, i.e. hash of every record is computed over its content
+// and hash of previous record, such that modification, insertion or removal
+// of records is detected by the verifier (GET /audit/verify end-point or
+// -verify-audit command line option). The hash of last record (chain head)
+// may be anchored externally to detect truncation of the log.
+//
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	services "github.com/CHESSComputing/golib/services"
+	"github.com/gin-gonic/gin"
+)
+
+// audit event types
+const (
+	auditToken   = "token"   // token issuance or denial
+	auditLogin   = "login"   // Kerberos login
+	auditTrusted = "trusted" // trusted client check
+)
+
+// AuditRecord represents audit_log table
+type AuditRecord struct {
+	ID       uint   `json:"id"`
+	EVENT    string `json:"event"`
+	OUTCOME  string `json:"outcome"` // allow, deny or warn
+	LOGIN    string `json:"login"`
+	CLIENT   string `json:"client_id"`
+	IP       string `json:"ip"`
+	SCOPE    string `json:"scope"`
+	KIND     string `json:"kind"`
+	REASON   string `json:"reason"`
+	TOKEN_ID string `json:"token_id"` // jti of issued token, we never record tokens
+	CREATED  int64  `json:"created"`  // time of the record in nanoseconds
+	PREVHASH string `json:"prev_hash"`
+	HASH     string `json:"hash"`
+}
+
+// AuditVerification represents result of audit log verification
+type AuditVerification struct {
+	Valid     bool   `json:"valid"`
+	Records   int    `json:"records"`
+	Head      string `json:"head"`                 // hash of last valid record
+	InvalidID uint   `json:"invalid_id,omitempty"` // ID of first invalid record
+	Reason    string `json:"reason,omitempty"`
+}
+
+// _auditMutex serializes appends to audit log within Authz process, while
+// unique prev_hash constraint guarantees linear chain across processes
+var _auditMutex sync.Mutex
+
+// helper function to compute hash of audit record
+func (a *AuditRecord) digest() string {
+	content := []string{a.EVENT, a.OUTCOME, a.LOGIN, a.CLIENT, a.IP, a.SCOPE, a.KIND, a.REASON, a.TOKEN_ID, strconv.FormatInt(a.CREATED, 10)}
+	data, _ := json.Marshal(content)
+	hash := sha256.Sum256(append([]byte(a.PREVHASH), data...))
+	return hex.EncodeToString(hash[:])
+}
+
+// appendAudit appends record to hash chain of audit log
+func appendAudit(db *sql.DB, rec *AuditRecord) error {
+	_auditMutex.Lock()
+	defer _auditMutex.Unlock()
+	var err error
+	// retry if concurrent process appended the record with the same prev_hash
+	for i := 0; i < 3; i++ {
+		if err = appendAuditRecord(db, rec); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// helper function to append audit record within transaction
+func appendAuditRecord(db *sql.DB, rec *AuditRecord) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("[Authz.main.appendAudit] db.Begin error: %w", err)
+	}
+	defer tx.Rollback()
+	var prev string
+	err = tx.QueryRow("SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1").Scan(&prev)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("[Authz.main.appendAudit] row.Scan error: %w", err)
+	}
+	rec.PREVHASH = prev
+	rec.HASH = rec.digest()
+	query := `
+	INSERT INTO audit_log (event, outcome, login, client_id, ip, scope, kind, reason, token_id, created, prev_hash, hash)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err = tx.Exec(query, rec.EVENT, rec.OUTCOME, rec.LOGIN, rec.CLIENT, rec.IP, rec.SCOPE,
+		rec.KIND, rec.REASON, rec.TOKEN_ID, rec.CREATED, rec.PREVHASH, rec.HASH)
+	if err != nil {
+		return fmt.Errorf("[Authz.main.appendAudit] tx.Exec error: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("[Authz.main.appendAudit] tx.Commit error: %w", err)
+	}
+	return nil
+}
+
+// helper function to record audit event of given HTTP request, audit
+// failures are logged but do not affect the request
+func audit(r *http.Request, rec AuditRecord) {
+	if r != nil {
+		rec.IP = getIP(r)
+	}
+	rec.CREATED = time.Now().UnixNano()
+	if err := appendAudit(_DB, &rec); err != nil {
+		log.Println("ERROR: unable to write audit record:", err)
+	}
+	if Verbose > 0 {
+		log.Printf("AUDIT: event=%s outcome=%s user=%s client=%s ip=%s scope=%s kind=%s jti=%s reason=%s",
+			rec.EVENT, rec.OUTCOME, rec.LOGIN, rec.CLIENT, rec.IP, rec.SCOPE, rec.KIND, rec.TOKEN_ID, rec.REASON)
+	}
+}
+
+// helper function to audit issued token
+func auditIssued(r *http.Request, tmap TokenMap, user, client, scope, kind string) {
+	_metrics.issued(kind, tmap.TokenID, tmap.Expires)
+	audit(r, AuditRecord{
+		EVENT:    auditToken,
+		OUTCOME:  "allow",
+		LOGIN:    user,
+		CLIENT:   client,
+		SCOPE:    scope,
+		KIND:     kind,
+		TOKEN_ID: tmap.TokenID,
+	})
+}
+
+// helper function to audit denied request
+func auditDenied(r *http.Request, event, user, client, scope, kind string, reason error) {
+	rec := AuditRecord{
+		EVENT:   event,
+		OUTCOME: "deny",
+		LOGIN:   user,
+		CLIENT:  client,
+		SCOPE:   scope,
+		KIND:    kind,
+	}
+	if reason != nil {
+		rec.REASON = reason.Error()
+	}
+	audit(r, rec)
+}
+
+// helper function to scan audit records
+func scanAuditRecords(rows *sql.Rows) ([]AuditRecord, error) {
+	defer rows.Close()
+	records := []AuditRecord{}
+	for rows.Next() {
+		var rec AuditRecord
+		err := rows.Scan(
+			&rec.ID,
+			&rec.EVENT,
+			&rec.OUTCOME,
+			&rec.LOGIN,
+			&rec.CLIENT,
+			&rec.IP,
+			&rec.SCOPE,
+			&rec.KIND,
+			&rec.REASON,
+			&rec.TOKEN_ID,
+			&rec.CREATED,
+			&rec.PREVHASH,
+			&rec.HASH)
+		if err != nil {
+			return nil, fmt.Errorf("[Authz.main.scanAuditRecords] rows.Scan error: %w", err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// audit log columns used by queries
+const auditColumns = "id, event, outcome, login, client_id, ip, scope, kind, reason, token_id, created, prev_hash, hash"
+
+// AuditQuery represents query parameters of audit log
+type AuditQuery struct {
+	User    string
+	Client  string
+	IP      string
+	Event   string
+	Outcome string
+	Since   int64 // unix time in seconds
+	Until   int64 // unix time in seconds
+	Limit   int
+}
+
+// queryAudit queries audit log records, the latest records come first
+func queryAudit(db *sql.DB, q AuditQuery) ([]AuditRecord, error) {
+	query := fmt.Sprintf("SELECT %s FROM audit_log WHERE 1 = 1", auditColumns)
+	var args []any
+	for _, cond := range []struct {
+		column string
+		value  string
+	}{{"login", q.User}, {"client_id", q.Client}, {"ip", q.IP}, {"event", q.Event}, {"outcome", q.Outcome}} {
+		if cond.value != "" {
+			query += fmt.Sprintf(" AND %s = ?", cond.column)
+			args = append(args, cond.value)
+		}
+	}
+	if q.Since > 0 {
+		query += " AND created >= ?"
+		args = append(args, q.Since*int64(time.Second))
+	}
+	if q.Until > 0 {
+		query += " AND created < ?"
+		args = append(args, q.Until*int64(time.Second))
+	}
+	if q.Limit <= 0 || q.Limit > 1000 {
+		q.Limit = 1000
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", q.Limit)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("[Authz.main.queryAudit] db.Query error: %w", err)
+	}
+	return scanAuditRecords(rows)
+}
+
+// verifyAudit verifies hash chain of audit log
+func verifyAudit(db *sql.DB) (AuditVerification, error) {
+	var result AuditVerification
+	// read audit log in batches to limit memory usage
+	var lastID uint
+	for {
+		query := fmt.Sprintf("SELECT %s FROM audit_log WHERE id > ? ORDER BY id LIMIT 1000", auditColumns)
+		rows, err := db.Query(query, lastID)
+		if err != nil {
+			return result, fmt.Errorf("[Authz.main.verifyAudit] db.Query error: %w", err)
+		}
+		records, err := scanAuditRecords(rows)
+		if err != nil {
+			return result, err
+		}
+		if len(records) == 0 {
+			break
+		}
+		for _, rec := range records {
+			if rec.PREVHASH != result.Head {
+				result.InvalidID = rec.ID
+				result.Reason = "broken hash chain, records were removed or inserted"
+				return result, nil
+			}
+			if rec.digest() != rec.HASH {
+				result.InvalidID = rec.ID
+				result.Reason = "record hash mismatch, record was modified"
+				return result, nil
+			}
+			result.Head = rec.HASH
+			result.Records++
+			lastID = rec.ID
+		}
+	}
+	result.Valid = true
+	return result, nil
+}
+
+// AuditHandler provides access to GET /audit end-point
+func AuditHandler(c *gin.Context) {
+	if !adminRequest(c) {
+		return
+	}
+	q := AuditQuery{
+		User:    c.Query("user"),
+		Client:  c.Query("client_id"),
+		IP:      c.Query("ip"),
+		Event:   c.Query("event"),
+		Outcome: c.Query("outcome"),
+	}
+	var err error
+	for _, param := range []struct {
+		name  string
+		value *int64
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if val := c.Query(param.name); val != "" && err == nil {
+			*param.value, err = strconv.ParseInt(val, 10, 64)
+		}
+	}
+	if val := c.Query("limit"); val != "" && err == nil {
+		q.Limit, err = strconv.Atoi(val)
+	}
+	if err != nil {
+		rec := services.Response("Authz", http.StatusBadRequest, services.ParametersError, err)
+		c.JSON(http.StatusBadRequest, rec)
+		return
+	}
+	records, err := queryAudit(_DB, q)
+	if err != nil {
+		rec := services.Response("Authz", http.StatusInternalServerError, services.DatabaseError, err)
+		c.JSON(http.StatusInternalServerError, rec)
+		return
+	}
+	c.JSON(http.StatusOK, records)
+}
+
+// AuditVerifyHandler provides access to GET /audit/verify end-point
+func AuditVerifyHandler(c *gin.Context) {
+	if !adminRequest(c) {
+		return
+	}
+	result, err := verifyAudit(_DB)
+	if err != nil {
+		rec := services.Response("Authz", http.StatusInternalServerError, services.DatabaseError, err)
+		c.JSON(http.StatusInternalServerError, rec)
+		return
+	}
+	if !result.Valid {
+		log.Printf("WARNING: audit log verification failed at record %d: %s", result.InvalidID, result.Reason)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// helper function to verify audit log from command line
+func verifyAuditLog() error {
+	result, err := verifyAudit(_DB)
+	if err != nil {
+		return err
+	}
+	data, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(data))
+	if !result.Valid {
+		return errors.New("audit log is tampered")
+	}
+	return nil
+}
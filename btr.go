@@ -0,0 +1,57 @@
+package main
+
+// BTR scopes module
+//
+// Clients may restrict token to specific beamtime runs (BTRs) by requesting
+// btr:<id> scopes, e.g. "read btr:12345". Every requested BTR should belong
+// to the user and the issued token carries only requested BTRs, such that
+// analysis job of a collaborator may only access data of its own experiment.
+//
+import (
+	"fmt"
+	"strings"
+
+	utils "github.com/CHESSComputing/golib/utils"
+)
+
+// btrScopePrefix defines prefix of BTR scopes
+const btrScopePrefix = "btr:"
+
+// helper function to extract BTRs from btr:<id> scopes of given scope
+func scopeBtrs(scope string) []string {
+	var btrs []string
+	for _, s := range scopes(scope) {
+		if strings.HasPrefix(s, btrScopePrefix) {
+			if btr := strings.TrimPrefix(s, btrScopePrefix); btr != "" && !utils.InList(btr, btrs) {
+				btrs = append(btrs, btr)
+			}
+		}
+	}
+	return btrs
+}
+
+// helper function to check that all BTRs of given scope belong to the user
+func checkBtrScopes(scope string, userBtrs []string) error {
+	for _, btr := range scopeBtrs(scope) {
+		if !utils.InList(btr, userBtrs) {
+			return fmt.Errorf("btr %s does not belong to the user", btr)
+		}
+	}
+	return nil
+}
+
+// helper function to restrict given BTRs to btr:<id> scopes, if scope does
+// not have BTR scopes we return all BTRs
+func restrictBtrs(btrs []string, scope string) []string {
+	requested := scopeBtrs(scope)
+	if len(requested) == 0 {
+		return btrs
+	}
+	out := []string{}
+	for _, btr := range requested {
+		if utils.InList(btr, btrs) {
+			out = append(out, btr)
+		}
+	}
+	return out
+}
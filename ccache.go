@@ -0,0 +1,133 @@
+package main
+
+// Kerberos credentials cache login module
+//
+// CLI users with valid Kerberos ticket may obtain token by uploading their
+// credentials cache (ccache) file to POST /oauth/ccache end-point, either as
+// multipart form
+//
+// kinit user@CLASSE.CORNELL.EDU
+// curl -F ccache=@/tmp/krb5cc_$(id -u) -F scope=read https://.../oauth/ccache
+//
+// or as JSON with base64 encoded ccache
+//
+// {"user": "user", "scope": "read", "expires": 3600, "ccache": "BQQADAAB..."}
+//
+// The ccache is parsed in memory and never written to disk. Its TGT is used
+// to obtain service ticket of Authz principal from KDC of its realm, which is
+// validated with Authz keytab (Kerberos.Keytab), such that only ccache with
+// TGT issued by KDC of allowed realm (see realms module) is accepted.
+//
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	services "github.com/CHESSComputing/golib/services"
+	"github.com/gin-gonic/gin"
+)
+
+// maxCCacheSize defines maximum size of ccache request
+const maxCCacheSize = 1 << 20
+
+// CCacheRequest represents request of POST /oauth/ccache end-point
+type CCacheRequest struct {
+	User    string `json:"user"`    // user name, by default principal of ccache
+	Scope   string `json:"scope"`   // token scope, by default read
+	Expires int64  `json:"expires"` // token expiration in seconds
+	CCache  []byte `json:"ccache"`  // base64 encoded ccache file
+}
+
+// helper function to read ccache request from multipart form or JSON body,
+// the multipart form is read part by part in memory since standard form
+// parsing stores large files in temporary files
+func readCCacheRequest(w http.ResponseWriter, r *http.Request) (CCacheRequest, error) {
+	var req CCacheRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxCCacheSize)
+	defer r.Body.Close()
+	ctype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ctype != "multipart/form-data" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, fmt.Errorf("[Authz.main.readCCacheRequest] json.Decode error: %w", err)
+		}
+		return req, nil
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return req, fmt.Errorf("[Authz.main.readCCacheRequest] r.MultipartReader error: %w", err)
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return req, fmt.Errorf("[Authz.main.readCCacheRequest] reader.NextPart error: %w", err)
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return req, fmt.Errorf("[Authz.main.readCCacheRequest] io.ReadAll error: %w", err)
+		}
+		switch part.FormName() {
+		case "ccache":
+			req.CCache = data
+		case "user":
+			req.User = string(data)
+		case "scope":
+			req.Scope = string(data)
+		case "expires":
+			if req.Expires, err = strconv.ParseInt(string(data), 10, 64); err != nil {
+				return req, fmt.Errorf("[Authz.main.readCCacheRequest] strconv.ParseInt error: %w", err)
+			}
+		}
+	}
+	return req, nil
+}
+
+// CCacheHandler provides access to POST /oauth/ccache end-point, it issues
+// token for user of uploaded Kerberos credentials cache
+func CCacheHandler(c *gin.Context) {
+	r := c.Request
+	if _keytab == nil {
+		err := errors.New("kerberos credentials cache login is not configured")
+		errorResponse(c, http.StatusNotImplemented, services.AuthError, err)
+		return
+	}
+	req, err := readCCacheRequest(c.Writer, r)
+	if err != nil {
+		errorResponse(c, http.StatusBadRequest, services.ReaderError, err)
+		return
+	}
+	creds, err := kuserFromCCache(req.CCache)
+	if err != nil {
+		auditDenied(r, auditLogin, req.User, "", req.Scope, "ccache", err)
+		errorResponse(c, http.StatusUnauthorized, services.CredentialsError, err)
+		return
+	}
+	user, realm, err := kerberosUser(creds)
+	if err != nil {
+		auditDenied(r, auditLogin, req.User, "", req.Scope, "ccache", err)
+		errorResponse(c, http.StatusUnauthorized, services.CredentialsError, err)
+		return
+	}
+	if req.User != "" && req.User != user {
+		auditDenied(r, auditLogin, req.User, "", req.Scope, "ccache",
+			fmt.Errorf("kerberos credentials belong to user %s", user))
+		errorResponse(c, http.StatusUnauthorized, services.CredentialsError, errors.New("User credentials error"))
+		return
+	}
+	audit(r, AuditRecord{EVENT: auditLogin, OUTCOME: "allow", LOGIN: user, KIND: "ccache"})
+	if !allowUser(c, user) {
+		return
+	}
+	scope := req.Scope
+	if scope == "" {
+		scope = "read"
+	}
+	// token can't outlive kerberos ticket
+	kerberosToken(c, user, realm, scope, ticketExpires(creds, req.Expires))
+}
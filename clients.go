@@ -0,0 +1,399 @@
+package main
+
+// OAuth client registry module
+//
+// OAuth clients are registered in clients table of Authz database. Every
+// client has hashed (bcrypt) secret, allowed grant types, allowed scopes,
+// redirect URIs, allowed token audiences and an owner. Clients without secret are public ones, e.g.
+// native applications using authorization code flow with PKCE.
+// FOXDEN admins manage clients via /clients end-points.
+//
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	authz "github.com/CHESSComputing/golib/authz"
+	services "github.com/CHESSComputing/golib/services"
+	utils "github.com/CHESSComputing/golib/utils"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ClientRecord represents clients table record
+type ClientRecord struct {
+	ClientID     string    `json:"client_id"`
+	ClientSecret string    `json:"client_secret,omitempty"` // only returned when secret is generated
+	Public       bool      `json:"public"`
+	GrantTypes   []string  `json:"grant_types"`
+	Scopes       []string  `json:"scopes"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Audiences    []string  `json:"audiences"`
+	RateLimit    RateLimit `json:"rate_limit"` // client quota, zero rate implies default limit
+	Owner        string    `json:"owner"`
+	Created      int64     `json:"created"`
+	Updated      int64     `json:"updated"`
+	RotateSecret bool      `json:"rotate_secret,omitempty"` // update request to generate new secret
+	secret       string    // hashed client secret
+}
+
+// ClientUpdate represents update request of registered client, the client
+// type is changed only if public flag is explicitly provided
+type ClientUpdate struct {
+	ClientRecord
+	Public *bool `json:"public"`
+}
+
+// Client returns OAuth client of the record
+func (rec *ClientRecord) Client() *Client {
+	return &Client{
+		ID:           rec.ClientID,
+		Secret:       rec.secret,
+		Hashed:       true,
+		RedirectURIs: rec.RedirectURIs,
+		GrantTypes:   rec.GrantTypes,
+		Scopes:       rec.Scopes,
+		Audiences:    rec.Audiences,
+		RateLimit:    rec.RateLimit,
+		Public:       rec.secret == "",
+		Owner:        rec.Owner,
+	}
+}
+
+// helper function to hash client secret
+func hashSecret(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("[Authz.main.hashSecret] bcrypt.GenerateFromPassword error: %w", err)
+	}
+	return string(hash), nil
+}
+
+// helper function to scan client record from database row
+func scanClient(row interface{ Scan(...any) error }) (ClientRecord, error) {
+	var rec ClientRecord
+	var grantTypes, scopes, redirectURIs, audiences string
+	err := row.Scan(&rec.ClientID, &rec.secret, &grantTypes, &scopes, &redirectURIs, &audiences, &rec.RateLimit.Rate, &rec.RateLimit.Burst, &rec.Owner, &rec.Created, &rec.Updated)
+	if err != nil {
+		return rec, err
+	}
+	rec.Public = rec.secret == ""
+	rec.GrantTypes = strings.Fields(grantTypes)
+	rec.Scopes = strings.Fields(scopes)
+	rec.RedirectURIs = strings.Fields(redirectURIs)
+	rec.Audiences = strings.Fields(audiences)
+	return rec, nil
+}
+
+// getClientRecord retrieves client record with given client ID
+func getClientRecord(db *sql.DB, clientId string) (ClientRecord, error) {
+	query := "SELECT client_id, secret, grant_types, scopes, redirect_uris, audiences, rate_limit, rate_burst, owner, created, updated FROM clients WHERE client_id = ?"
+	rec, err := scanClient(db.QueryRow(query, clientId))
+	if err == sql.ErrNoRows {
+		return rec, fmt.Errorf("client %s is not found", clientId)
+	} else if err != nil {
+		return rec, fmt.Errorf("[Authz.main.getClientRecord] row.Scan error: %w", err)
+	}
+	return rec, nil
+}
+
+// listClientRecords retrieves all registered clients
+func listClientRecords(db *sql.DB) ([]ClientRecord, error) {
+	query := "SELECT client_id, secret, grant_types, scopes, redirect_uris, audiences, rate_limit, rate_burst, owner, created, updated FROM clients ORDER BY client_id"
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("[Authz.main.listClientRecords] db.Query error: %w", err)
+	}
+	defer rows.Close()
+	records := []ClientRecord{}
+	for rows.Next() {
+		rec, err := scanClient(rows)
+		if err != nil {
+			return nil, fmt.Errorf("[Authz.main.listClientRecords] rows.Scan error: %w", err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// helper function to generate client secret unless client is public one
+func generateSecret(rec *ClientRecord) error {
+	rec.ClientSecret = ""
+	rec.secret = ""
+	if rec.Public {
+		return nil
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	hash, err := hashSecret(secret)
+	if err != nil {
+		return err
+	}
+	rec.ClientSecret = secret
+	rec.secret = hash
+	return nil
+}
+
+// createClientRecord registers new client, it generates client secret
+// which is returned only once
+func createClientRecord(db *sql.DB, rec *ClientRecord) error {
+	if rec.ClientID == "" {
+		id, err := randomToken(16)
+		if err != nil {
+			return err
+		}
+		rec.ClientID = id
+	}
+	if err := generateSecret(rec); err != nil {
+		return err
+	}
+	rec.Created = time.Now().Unix()
+	rec.Updated = rec.Created
+	query := `
+	INSERT INTO clients (client_id, secret, grant_types, scopes, redirect_uris, audiences, rate_limit, rate_burst, owner, created, updated)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := db.Exec(query, rec.ClientID, rec.secret,
+		strings.Join(rec.GrantTypes, " "), strings.Join(rec.Scopes, " "), strings.Join(rec.RedirectURIs, " "),
+		strings.Join(rec.Audiences, " "), rec.RateLimit.Rate, rec.RateLimit.Burst, rec.Owner, rec.Created, rec.Updated)
+	if err != nil {
+		return fmt.Errorf("[Authz.main.createClientRecord] db.Exec error: %w", err)
+	}
+	return nil
+}
+
+// updateClientRecord updates registered client
+func updateClientRecord(db *sql.DB, rec *ClientRecord) error {
+	rec.Updated = time.Now().Unix()
+	query := `
+	UPDATE clients SET secret = ?, grant_types = ?, scopes = ?, redirect_uris = ?, audiences = ?,
+	rate_limit = ?, rate_burst = ?, owner = ?, updated = ?
+	WHERE client_id = ?
+	`
+	result, err := db.Exec(query, rec.secret,
+		strings.Join(rec.GrantTypes, " "), strings.Join(rec.Scopes, " "), strings.Join(rec.RedirectURIs, " "),
+		strings.Join(rec.Audiences, " "), rec.RateLimit.Rate, rec.RateLimit.Burst, rec.Owner, rec.Updated, rec.ClientID)
+	if err != nil {
+		return fmt.Errorf("[Authz.main.updateClientRecord] db.Exec error: %w", err)
+	}
+	if nrows, err := result.RowsAffected(); err == nil && nrows == 0 {
+		return fmt.Errorf("client %s is not found", rec.ClientID)
+	}
+	return nil
+}
+
+// deleteClientRecord removes registered client
+func deleteClientRecord(db *sql.DB, clientId string) error {
+	result, err := db.Exec("DELETE FROM clients WHERE client_id = ?", clientId)
+	if err != nil {
+		return fmt.Errorf("[Authz.main.deleteClientRecord] db.Exec error: %w", err)
+	}
+	if nrows, err := result.RowsAffected(); err == nil && nrows == 0 {
+		return fmt.Errorf("client %s is not found", clientId)
+	}
+	return nil
+}
+
+// helper function to authenticate OAuth client of the request against
+// client registry, public clients are identified by client ID only
+func authenticateClient(r *http.Request) (*Client, error) {
+	clientId, clientSecret := clientCredentials(r)
+	client, err := getClient(clientId)
+	if err != nil {
+		return nil, err
+	}
+	if !client.VerifyPassword(clientSecret) {
+		return nil, fmt.Errorf("client %s authentication failed", clientId)
+	}
+	return client, nil
+}
+
+// helper function to authenticate confidential OAuth client, i.e. client with secret
+func authenticateConfidentialClient(r *http.Request) (*Client, error) {
+	client, err := authenticateClient(r)
+	if err != nil {
+		return nil, err
+	}
+	if client.Public {
+		return nil, fmt.Errorf("public client %s is not allowed", client.ID)
+	}
+	return client, nil
+}
+
+// helper function to ensure that request is made by FOXDEN admin
+func adminRequest(c *gin.Context) bool {
+	if val, ok := c.Get("claims"); ok {
+		if claims, ok := val.(*authz.Claims); ok && isAdmin(claims) {
+			return true
+		}
+	}
+	rec := services.Response("Authz", http.StatusForbidden, services.AuthError, errors.New("admin privileges are required"))
+	c.JSON(http.StatusForbidden, rec)
+	return false
+}
+
+// helper function to read and validate client record from request body
+func readClientRecord(c *gin.Context) (ClientRecord, error) {
+	var rec ClientRecord
+	if err := readClientBody(c, &rec); err != nil {
+		return rec, err
+	}
+	return rec, validateClientRecord(rec)
+}
+
+// helper function to read and validate client update request from request body
+func readClientUpdate(c *gin.Context) (ClientUpdate, error) {
+	var rec ClientUpdate
+	if err := readClientBody(c, &rec); err != nil {
+		return rec, err
+	}
+	return rec, validateClientRecord(rec.ClientRecord)
+}
+
+// helper function to unmarshal request body into given client record
+func readClientBody(c *gin.Context, rec any) error {
+	defer c.Request.Body.Close()
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, rec)
+}
+
+// helper function to validate client record
+func validateClientRecord(rec ClientRecord) error {
+	for _, gt := range rec.GrantTypes {
+		if !utils.InList(gt, supportedGrantTypes()) {
+			return fmt.Errorf("grant type %s is not supported", gt)
+		}
+	}
+	for _, val := range append(rec.RedirectURIs, rec.Audiences...) {
+		if val == "" || strings.ContainsAny(val, " \t\n") {
+			return fmt.Errorf("invalid redirect URI or audience '%s'", val)
+		}
+	}
+	if rec.RateLimit.Burst < 0 {
+		return fmt.Errorf("invalid rate limit burst %d", rec.RateLimit.Burst)
+	}
+	return nil
+}
+
+// ClientsHandler provides access to GET /clients end-point
+func ClientsHandler(c *gin.Context) {
+	if !adminRequest(c) {
+		return
+	}
+	records, err := listClientRecords(_DB)
+	if err != nil {
+		rec := services.Response("Authz", http.StatusInternalServerError, services.DatabaseError, err)
+		c.JSON(http.StatusInternalServerError, rec)
+		return
+	}
+	c.JSON(http.StatusOK, records)
+}
+
+// ClientHandler provides access to GET /clients/:id end-point
+func ClientHandler(c *gin.Context) {
+	if !adminRequest(c) {
+		return
+	}
+	rec, err := getClientRecord(_DB, c.Param("id"))
+	if err != nil {
+		rec := services.Response("Authz", http.StatusNotFound, services.DatabaseError, err)
+		c.JSON(http.StatusNotFound, rec)
+		return
+	}
+	c.JSON(http.StatusOK, rec)
+}
+
+// CreateClientHandler provides access to POST /clients end-point
+func CreateClientHandler(c *gin.Context) {
+	if !adminRequest(c) {
+		return
+	}
+	rec, err := readClientRecord(c)
+	if err != nil {
+		rec := services.Response("Authz", http.StatusBadRequest, services.UnmarshalError, err)
+		c.JSON(http.StatusBadRequest, rec)
+		return
+	}
+	if _, err := getClient(rec.ClientID); rec.ClientID != "" && err == nil {
+		err := fmt.Errorf("client %s already exists", rec.ClientID)
+		rec := services.Response("Authz", http.StatusBadRequest, services.ParametersError, err)
+		c.JSON(http.StatusBadRequest, rec)
+		return
+	}
+	if err := createClientRecord(_DB, &rec); err != nil {
+		rec := services.Response("Authz", http.StatusInternalServerError, services.DatabaseError, err)
+		c.JSON(http.StatusInternalServerError, rec)
+		return
+	}
+	log.Printf("INFO: client %s is registered, owner %s", rec.ClientID, rec.Owner)
+	c.JSON(http.StatusOK, rec)
+}
+
+// UpdateClientHandler provides access to PUT /clients/:id end-point
+func UpdateClientHandler(c *gin.Context) {
+	if !adminRequest(c) {
+		return
+	}
+	update, err := readClientUpdate(c)
+	if err != nil {
+		rec := services.Response("Authz", http.StatusBadRequest, services.UnmarshalError, err)
+		c.JSON(http.StatusBadRequest, rec)
+		return
+	}
+	orig, err := getClientRecord(_DB, c.Param("id"))
+	if err != nil {
+		rec := services.Response("Authz", http.StatusNotFound, services.DatabaseError, err)
+		c.JSON(http.StatusNotFound, rec)
+		return
+	}
+	// client type is kept unless public flag is explicitly provided
+	rec := update.ClientRecord
+	rec.ClientID = orig.ClientID
+	rec.Created = orig.Created
+	rec.secret = orig.secret
+	rec.Public = orig.Public
+	if update.Public != nil {
+		rec.Public = *update.Public
+	}
+	if rec.RotateSecret || rec.Public != orig.Public {
+		if err := generateSecret(&rec); err != nil {
+			rec := services.Response("Authz", http.StatusInternalServerError, services.ParametersError, err)
+			c.JSON(http.StatusInternalServerError, rec)
+			return
+		}
+	}
+	rec.RotateSecret = false
+	if err := updateClientRecord(_DB, &rec); err != nil {
+		rec := services.Response("Authz", http.StatusInternalServerError, services.DatabaseError, err)
+		c.JSON(http.StatusInternalServerError, rec)
+		return
+	}
+	log.Printf("INFO: client %s is updated", rec.ClientID)
+	c.JSON(http.StatusOK, rec)
+}
+
+// DeleteClientHandler provides access to DELETE /clients/:id end-point
+func DeleteClientHandler(c *gin.Context) {
+	if !adminRequest(c) {
+		return
+	}
+	clientId := c.Param("id")
+	if err := deleteClientRecord(_DB, clientId); err != nil {
+		rec := services.Response("Authz", http.StatusNotFound, services.DatabaseError, err)
+		c.JSON(http.StatusNotFound, rec)
+		return
+	}
+	log.Printf("INFO: client %s is deleted", clientId)
+	c.JSON(http.StatusOK, gin.H{"client_id": clientId, "deleted": true})
+}
@@ -0,0 +1,56 @@
+package main
+
+// OAuth client registry tests
+//
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	authz "github.com/CHESSComputing/golib/authz"
+	"github.com/gin-gonic/gin"
+)
+
+// helper function to update client via PUT /clients/:id as FOXDEN admin
+func updateClient(t *testing.T, clientId, body string) ClientRecord {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("PUT", "/clients/"+clientId, strings.NewReader(body))
+	c.Params = gin.Params{{Key: "id", Value: clientId}}
+	claims := &authz.Claims{}
+	claims.CustomClaims.Groups = []string{"foxdenadmin"}
+	c.Set("claims", claims)
+	UpdateClientHandler(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	rec, err := getClientRecord(_DB, clientId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+// TestUpdateClientPublic tests that client type is changed only if public
+// flag is explicitly provided in update request
+func TestUpdateClientPublic(t *testing.T) {
+	setupKerberosTest(t)
+	rec := ClientRecord{ClientID: "public", Public: true}
+	if err := createClientRecord(_DB, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec := updateClient(t, "public", `{"scopes":["read"]}`); !rec.Public {
+		t.Fatal("public client became confidential without public flag")
+	}
+	if rec := updateClient(t, "public", `{"public":false}`); rec.Public {
+		t.Fatal("public client is not converted to confidential one")
+	}
+	if rec := updateClient(t, "public", `{"scopes":["read"]}`); rec.Public {
+		t.Fatal("confidential client became public without public flag")
+	}
+	if rec := updateClient(t, "public", `{"public":true}`); !rec.Public {
+		t.Fatal("confidential client is not converted to public one")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+// configuration module
+//
+// Authz specific options which are not part of FOXDEN golib configuration.
+// They are read from the same Authz section of FOXDEN configuration file
+// which is already loaded by srvConfig.ParseConfig, e.g.
+//
+// Authz:
+//   ClientId: ...
+//   RefreshTokenExpires: 2592000
+//
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// OAuthClient represents OAuth client defined in Authz configuration
+type OAuthClient struct {
+	ClientID     string    `mapstructure:"ClientId"`     // client ID
+	ClientSecret string    `mapstructure:"ClientSecret"` // client secret, empty for public clients
+	RedirectURIs []string  `mapstructure:"RedirectURIs"` // registered redirect URIs
+	Audiences    []string  `mapstructure:"Audiences"`    // allowed token audiences
+	RateLimit    RateLimit `mapstructure:"RateLimit"`    // client quota of token requests
+}
+
+// Configuration represents Authz specific configuration
+type Configuration struct {
+	RefreshTokenExpires  int64           `mapstructure:"RefreshTokenExpires"`  // refresh token expiration in seconds
+	Clients              []OAuthClient   `mapstructure:"Clients"`              // OAuth clients
+	Issuer               string          `mapstructure:"Issuer"`               // OpenID issuer, by default Services.AuthzUrl
+	Keyring              string          `mapstructure:"Keyring"`              // directory of signing keys
+	SigningAlg           string          `mapstructure:"SigningAlg"`           // RS256, ES256 or EdDSA to sign access tokens, empty for HS512
+	KeyRotation          int64           `mapstructure:"KeyRotation"`          // key rotation interval in seconds, 0 disables rotation
+	KeyPublishAhead      int64           `mapstructure:"KeyPublishAhead"`      // publish next key given seconds before its activation
+	KeyRetention         int64           `mapstructure:"KeyRetention"`         // keep retired keys in JWKS for given seconds
+	ScopePolicy          string          `mapstructure:"ScopePolicy"`          // YAML or JSON file with scope policy
+	ElevationMaxDuration int64           `mapstructure:"ElevationMaxDuration"` // maximum duration of scope elevation in seconds
+	LoginMaxFailures     int64           `mapstructure:"LoginMaxFailures"`     // number of failed logins to lock out user
+	LoginMaxIPFailures   int64           `mapstructure:"LoginMaxIPFailures"`   // number of failed logins to lock out client IP
+	LoginLockout         int64           `mapstructure:"LoginLockout"`         // initial lockout period in seconds
+	LoginMaxLockout      int64           `mapstructure:"LoginMaxLockout"`      // maximum lockout period in seconds
+	LoginFailureWindow   int64           `mapstructure:"LoginFailureWindow"`   // period in seconds to forget failed logins
+	RateLimits           RateLimits      `mapstructure:"RateLimits"`           // rate limits of token end-points
+	TrustedProxies       []string        `mapstructure:"TrustedProxies"`       // CIDRs of reverse proxies allowed to set forwarded headers
+	TrustedClientWindow  int64           `mapstructure:"TrustedClientWindow"`  // allowed age of trusted client payload in seconds
+	TrustedClientStrict  bool            `mapstructure:"TrustedClientStrict"`  // reject trusted client payloads without timestamp and nonce
+	KerberosClockSkew    int64           `mapstructure:"KerberosClockSkew"`    // allowed clock skew of Kerberos authenticators in seconds
+	KerberosRealms       []KerberosRealm `mapstructure:"KerberosRealms"`       // Kerberos realms accepted by Authz
+}
+
+// _config holds Authz specific configuration
+var _config Configuration
+
+// helper function to parse Authz specific configuration and set its defaults
+func parseConfig() error {
+	var config Configuration
+	if err := viper.UnmarshalKey("Authz", &config); err != nil {
+		return fmt.Errorf("[Authz.main.parseConfig] viper.UnmarshalKey error: %w", err)
+	}
+	if config.RefreshTokenExpires == 0 {
+		config.RefreshTokenExpires = 30 * 24 * 3600 // refresh tokens expire in 30 days
+	}
+	if config.KeyPublishAhead == 0 {
+		config.KeyPublishAhead = 24 * 3600 // publish next key one day before rotation
+	}
+	if config.KeyRetention == 0 {
+		config.KeyRetention = 7 * 24 * 3600 // keep retired keys for one week
+	}
+	proxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("[Authz.main.parseConfig] parseTrustedProxies error: %w", err)
+	}
+	if err := validateRealms(config.KerberosRealms); err != nil {
+		return fmt.Errorf("[Authz.main.parseConfig] validateRealms error: %w", err)
+	}
+	_trustedProxies = proxies
+	_config = config
+	return nil
+}
@@ -0,0 +1,328 @@
+package main
+
+// device authorization grant module
+//
+// It implements OAuth2 device authorization grant (RFC 8628) for headless
+// hosts without browser or Kerberos client. The device obtains device and
+// user codes from /oauth/device_authorization end-point, the user approves
+// user code via web login page (/device which posts to /kauth), while the
+// device polls /oauth/token end-point until the code is approved.
+//
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	srvConfig "github.com/CHESSComputing/golib/config"
+	server "github.com/CHESSComputing/golib/server"
+	utils "github.com/CHESSComputing/golib/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// device code parameters
+const (
+	deviceCodeExpires  = 600 // device codes expire in 10 minutes
+	deviceCodeInterval = 5   // minimal polling interval in seconds
+	deviceGrantType    = "urn:ietf:params:oauth:grant-type:device_code"
+	userCodeCharset    = "BCDFGHJKLMNPQRSTVWXZ" // no vowels to avoid words, see RFC 8628 section 6.1
+)
+
+// DeviceCode represents device_codes table
+type DeviceCode struct {
+	ID            uint   `json:"id"`
+	DEVICE_CODE   string `json:"device_code"` // sha256 hash of device code
+	USER_CODE     string `json:"user_code"`
+	CLIENT_ID     string `json:"client_id"`
+	SCOPE         string `json:"scope"`
+	STATUS        string `json:"status"` // pending, approved or used
+	LOGIN         string `json:"login"`
+	POLL_INTERVAL int64  `json:"poll_interval"`
+	LAST_POLL     int64  `json:"last_poll"`
+	EXPIRES       int64  `json:"expires"`
+	CREATED       int64  `json:"created"`
+}
+
+// DeviceAuthorization represents device authorization response, see RFC 8628 section 3.2
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	Expires                 int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// helper function to generate user code in XXXX-XXXX form, characters are
+// drawn uniformly from userCodeCharset
+func newUserCode() (string, error) {
+	size := big.NewInt(int64(len(userCodeCharset)))
+	var code []byte
+	for i := 0; i < 8; i++ {
+		if i == 4 {
+			code = append(code, '-')
+		}
+		idx, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return "", fmt.Errorf("[Authz.main.newUserCode] rand.Int error: %w", err)
+		}
+		code = append(code, userCodeCharset[idx.Int64()])
+	}
+	return string(code), nil
+}
+
+// helper function to normalize user code typed by the user
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.ReplaceAll(code, " ", "")
+	code = strings.ReplaceAll(code, "-", "")
+	if len(code) == 8 {
+		code = code[:4] + "-" + code[4:]
+	}
+	return code
+}
+
+// helper function to query device code record
+func getDeviceCode(db *sql.DB, column, value string) (DeviceCode, error) {
+	var rec DeviceCode
+	query := fmt.Sprintf("SELECT id, device_code, user_code, client_id, scope, status, login, poll_interval, last_poll, expires, created FROM device_codes WHERE %s = ?", column)
+	err := db.QueryRow(query, value).Scan(
+		&rec.ID,
+		&rec.DEVICE_CODE,
+		&rec.USER_CODE,
+		&rec.CLIENT_ID,
+		&rec.SCOPE,
+		&rec.STATUS,
+		&rec.LOGIN,
+		&rec.POLL_INTERVAL,
+		&rec.LAST_POLL,
+		&rec.EXPIRES,
+		&rec.CREATED)
+	if err == sql.ErrNoRows {
+		return rec, errors.New("device code is not found")
+	} else if err != nil {
+		return rec, fmt.Errorf("[Authz.main.getDeviceCode] row.Scan error: %w", err)
+	}
+	return rec, nil
+}
+
+// createDeviceCode creates new device code for given client and scope
+func createDeviceCode(db *sql.DB, clientId, scope string) (string, string, error) {
+	deviceCode, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now().Unix()
+	query := `
+	INSERT INTO device_codes (device_code, user_code, client_id, scope, status, login, poll_interval, last_poll, expires, created)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	// retry on (unlikely) user code collision
+	for i := 0; i < 3; i++ {
+		userCode, err := newUserCode()
+		if err != nil {
+			return "", "", err
+		}
+		_, err = db.Exec(query, hashToken(deviceCode), userCode, clientId, scope, "pending", "",
+			deviceCodeInterval, 0, now+deviceCodeExpires, now)
+		if err == nil {
+			return deviceCode, userCode, nil
+		}
+		log.Println("ERROR: failed to create device code:", err)
+	}
+	return "", "", errors.New("[Authz.main.createDeviceCode] unable to create device code")
+}
+
+// approveDeviceCode approves pending device code on behalf of given user
+func approveDeviceCode(db *sql.DB, userCode, user string) (DeviceCode, error) {
+	rec, err := getDeviceCode(db, "user_code", normalizeUserCode(userCode))
+	if err != nil {
+		return rec, err
+	}
+	if rec.EXPIRES < time.Now().Unix() {
+		return rec, errors.New("device code is expired")
+	}
+	if _, err := checkUserScope(user, rec.SCOPE); err != nil {
+		return rec, err
+	}
+	query := "UPDATE device_codes SET status = ?, login = ? WHERE id = ? AND status = ?"
+	result, err := db.Exec(query, "approved", user, rec.ID, "pending")
+	if err != nil {
+		return rec, fmt.Errorf("[Authz.main.approveDeviceCode] db.Exec error: %w", err)
+	}
+	if nrows, err := result.RowsAffected(); err != nil || nrows != 1 {
+		return rec, errors.New("device code is already approved")
+	}
+	rec.STATUS = "approved"
+	rec.LOGIN = user
+	return rec, nil
+}
+
+// helper function to update polling time and interval of device code
+func pollDeviceCode(db *sql.DB, id uint, interval, lastPoll int64) error {
+	query := "UPDATE device_codes SET poll_interval = ?, last_poll = ? WHERE id = ?"
+	if _, err := db.Exec(query, interval, lastPoll, id); err != nil {
+		return fmt.Errorf("[Authz.main.pollDeviceCode] db.Exec error: %w", err)
+	}
+	return nil
+}
+
+// helper function to mark approved device code as used, it returns false
+// if code was already used (e.g. by concurrent request)
+func useDeviceCode(db *sql.DB, id uint) (bool, error) {
+	query := "UPDATE device_codes SET status = ? WHERE id = ? AND status = ?"
+	result, err := db.Exec(query, "used", id, "approved")
+	if err != nil {
+		return false, fmt.Errorf("[Authz.main.useDeviceCode] db.Exec error: %w", err)
+	}
+	nrows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("[Authz.main.useDeviceCode] result.RowsAffected error: %w", err)
+	}
+	return nrows == 1, nil
+}
+
+// cleanupDeviceCodes removes expired device codes
+func cleanupDeviceCodes(db *sql.DB) error {
+	query := "DELETE FROM device_codes WHERE expires < ?"
+	if _, err := db.Exec(query, time.Now().Unix()); err != nil {
+		return fmt.Errorf("[Authz.main.cleanupDeviceCodes] db.Exec error: %w", err)
+	}
+	return nil
+}
+
+// DeviceAuthorizationHandler provides access to POST /oauth/device_authorization end-point
+func DeviceAuthorizationHandler(c *gin.Context) {
+	r := c.Request
+	client, err := authenticateClient(r)
+	if err != nil {
+		oauthError(c, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+	if !allowClient(c, client) {
+		return
+	}
+	if !client.AllowedGrant(deviceGrantType) {
+		oauthError(c, http.StatusBadRequest, "unauthorized_client", "client is not allowed to use device flow")
+		return
+	}
+	scope := r.FormValue("scope")
+	if scope == "" {
+		scope = "read"
+	}
+	if !client.AllowedScope(scope) {
+		oauthError(c, http.StatusBadRequest, "invalid_scope", fmt.Sprintf("client is not allowed to request scope %s", scope))
+		return
+	}
+	deviceCode, userCode, err := createDeviceCode(_DB, client.ID, scope)
+	if err != nil {
+		log.Println("ERROR:", err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "unable to create device code")
+		return
+	}
+	uri := issuer() + "/device"
+	rec := DeviceAuthorization{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         uri,
+		VerificationURIComplete: fmt.Sprintf("%s?user_code=%s", uri, url.QueryEscape(userCode)),
+		Expires:                 deviceCodeExpires,
+		Interval:                deviceCodeInterval,
+	}
+	c.JSON(http.StatusOK, rec)
+}
+
+// deviceCodeGrant handles grant_type=urn:ietf:params:oauth:grant-type:device_code
+// requests of /oauth/token end-point
+func deviceCodeGrant(c *gin.Context) {
+	r := c.Request
+	client, err := authenticateClient(r)
+	if err != nil {
+		oauthError(c, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+	if !allowClient(c, client) {
+		return
+	}
+	rec, err := getDeviceCode(_DB, "device_code", hashToken(r.FormValue("device_code")))
+	if err != nil || rec.CLIENT_ID != client.ID {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "unknown device code")
+		return
+	}
+	if !allowUser(c, rec.LOGIN) {
+		return
+	}
+	audience, err := clientAudience(client, requestAudience(r))
+	if err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_target", err.Error())
+		return
+	}
+	now := time.Now().Unix()
+	if rec.EXPIRES < now {
+		oauthError(c, http.StatusBadRequest, "expired_token", "device code is expired")
+		return
+	}
+	switch rec.STATUS {
+	case "pending":
+		// the device should increase its polling interval by 5 seconds on slow_down error
+		interval := rec.POLL_INTERVAL
+		code := "authorization_pending"
+		if now-rec.LAST_POLL < rec.POLL_INTERVAL {
+			interval += 5
+			code = "slow_down"
+		}
+		if err := pollDeviceCode(_DB, rec.ID, interval, now); err != nil {
+			log.Println("ERROR:", err)
+		}
+		oauthError(c, http.StatusBadRequest, code, "device code is not approved yet")
+		return
+	case "approved":
+		if used, err := useDeviceCode(_DB, rec.ID); err != nil || !used {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "device code is already used")
+			return
+		}
+	default:
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "device code is already used")
+		return
+	}
+
+	tmap, err := tokenMap(rec.LOGIN, rec.SCOPE, "device", "Authz", 0, audience...)
+	if err == nil {
+		err = addRefreshToken(&tmap, "", rec.LOGIN, client.ID, rec.SCOPE, "device")
+	}
+	if err == nil && utils.InList("openid", scopes(rec.SCOPE)) {
+		err = addIDToken(&tmap, rec.LOGIN, client.ID, "")
+	}
+	if err != nil {
+		log.Println("ERROR:", err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "unable to issue access token")
+		return
+	}
+	auditIssued(r, tmap, rec.LOGIN, client.ID, rec.SCOPE, "device")
+	c.JSON(http.StatusOK, tmap)
+}
+
+// helper function to approve device code from login page and report
+// the result to the user
+func deviceApproval(c *gin.Context, userCode, user string) {
+	rec, err := approveDeviceCode(_DB, userCode, user)
+	if err != nil {
+		log.Printf("ERROR: user %s unable to approve device code: %v", user, err)
+		handleError(c, "unable to approve device code", err)
+		return
+	}
+	log.Printf("INFO: user %s approved device code of client %s, scope %s, IP %s", user, rec.CLIENT_ID, rec.SCOPE, getIP(c.Request))
+	tmpl := server.MakeTmpl(StaticFs, "Device")
+	tmpl["Base"] = srvConfig.Config.Authz.WebServer.Base
+	tmpl["Content"] = fmt.Sprintf("Device of %s client is approved with scope '%s', you may close this page", rec.CLIENT_ID, rec.SCOPE)
+	header := server.TmplPage(StaticFs, "header.tmpl", tmpl)
+	footer := server.TmplPage(StaticFs, "footer.tmpl", tmpl)
+	content := server.TmplPage(StaticFs, "success.tmpl", tmpl)
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(header+content+footer))
+}
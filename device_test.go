@@ -0,0 +1,32 @@
+package main
+
+// device authorization grant tests
+//
+import (
+	"strings"
+	"testing"
+)
+
+// TestNewUserCode tests format of user codes and that every character of
+// userCodeCharset is used
+func TestNewUserCode(t *testing.T) {
+	counts := make(map[rune]int)
+	for i := 0; i < 1000; i++ {
+		code, err := newUserCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != 9 || code[4] != '-' || normalizeUserCode(code) != code {
+			t.Fatalf("invalid user code %s", code)
+		}
+		for _, r := range strings.ReplaceAll(code, "-", "") {
+			if !strings.ContainsRune(userCodeCharset, r) {
+				t.Fatalf("user code %s has character %c out of charset", code, r)
+			}
+			counts[r]++
+		}
+	}
+	if len(counts) != len(userCodeCharset) {
+		t.Errorf("user codes use %d of %d characters", len(counts), len(userCodeCharset))
+	}
+}
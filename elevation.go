@@ -0,0 +1,438 @@
+package main
+
+// scope elevation module
+//
+// Users may request temporary (just-in-time) elevation of their privileges,
+// e.g. delete scope for a single cleanup job, instead of permanent change of
+// their groups in user attributes backend. The user files elevation request
+// with scope, reason and duration, FOXDEN admins approve or deny it via web
+// UI (/elevation) or API (/elevations), and approved elevation is honored by
+// Kerberos token end-point (POST /oauth/authorize) until it expires.
+//
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	authz "github.com/CHESSComputing/golib/authz"
+	srvConfig "github.com/CHESSComputing/golib/config"
+	server "github.com/CHESSComputing/golib/server"
+	services "github.com/CHESSComputing/golib/services"
+	utils "github.com/CHESSComputing/golib/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// elevation request parameters
+const (
+	elevationPendingExpires = 7 * 24 * 3600 // pending requests expire in one week
+	elevationMaxDuration    = 24 * 3600     // default maximum duration of elevation
+)
+
+// Elevation represents elevations table
+type Elevation struct {
+	ID       uint   `json:"id"`
+	LOGIN    string `json:"login"`
+	SCOPE    string `json:"scope"`
+	REASON   string `json:"reason"`
+	DURATION int64  `json:"duration"` // requested duration of elevation in seconds
+	STATUS   string `json:"status"`   // pending, approved, denied or expired
+	APPROVER string `json:"approver"` // admin who approved or denied the request
+	DECIDED  int64  `json:"decided"`
+	EXPIRES  int64  `json:"expires"` // expiration of pending request or approved elevation
+	CREATED  int64  `json:"created"`
+}
+
+// ElevationRequest represents user request of scope elevation
+type ElevationRequest struct {
+	Scope    string `json:"scope"`
+	Reason   string `json:"reason"`
+	Duration int64  `json:"duration"` // duration in seconds
+}
+
+// helper function to return maximum duration of elevation
+func maxElevationDuration() int64 {
+	if _config.ElevationMaxDuration > 0 {
+		return _config.ElevationMaxDuration
+	}
+	return elevationMaxDuration
+}
+
+// helper function to validate elevation request
+func (r *ElevationRequest) validate() error {
+	r.Scope = strings.Join(scopes(r.Scope), " ")
+	r.Reason = strings.TrimSpace(r.Reason)
+	if r.Scope == "" {
+		return errors.New("scope is required")
+	}
+	if r.Reason == "" {
+		return errors.New("reason is required")
+	}
+	if r.Duration <= 0 || r.Duration > maxElevationDuration() {
+		return fmt.Errorf("duration should be within (0, %d] seconds", maxElevationDuration())
+	}
+	return nil
+}
+
+// helper function to scan elevation record
+func scanElevation(row interface{ Scan(...any) error }) (Elevation, error) {
+	var rec Elevation
+	err := row.Scan(
+		&rec.ID,
+		&rec.LOGIN,
+		&rec.SCOPE,
+		&rec.REASON,
+		&rec.DURATION,
+		&rec.STATUS,
+		&rec.APPROVER,
+		&rec.DECIDED,
+		&rec.EXPIRES,
+		&rec.CREATED)
+	return rec, err
+}
+
+// elevation columns used by queries
+const elevationColumns = "id, login, scope, reason, duration, status, approver, decided, expires, created"
+
+// getElevation retrieves elevation record with given ID
+func getElevation(db *sql.DB, id uint) (Elevation, error) {
+	query := fmt.Sprintf("SELECT %s FROM elevations WHERE id = ?", elevationColumns)
+	rec, err := scanElevation(db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return rec, fmt.Errorf("elevation %d is not found", id)
+	} else if err != nil {
+		return rec, fmt.Errorf("[Authz.main.getElevation] row.Scan error: %w", err)
+	}
+	return rec, nil
+}
+
+// listElevations lists elevation records, optionally filtered by user login and status
+func listElevations(db *sql.DB, login, status string) ([]Elevation, error) {
+	query := fmt.Sprintf("SELECT %s FROM elevations WHERE 1 = 1", elevationColumns)
+	var args []any
+	if login != "" {
+		query += " AND login = ?"
+		args = append(args, login)
+	}
+	if status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY id DESC"
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("[Authz.main.listElevations] db.Query error: %w", err)
+	}
+	defer rows.Close()
+	records := []Elevation{}
+	for rows.Next() {
+		rec, err := scanElevation(rows)
+		if err != nil {
+			return nil, fmt.Errorf("[Authz.main.listElevations] rows.Scan error: %w", err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// createElevation files new elevation request of given user
+func createElevation(db *sql.DB, login string, req ElevationRequest) (Elevation, error) {
+	now := time.Now().Unix()
+	rec := Elevation{
+		LOGIN:    login,
+		SCOPE:    req.Scope,
+		REASON:   req.Reason,
+		DURATION: req.Duration,
+		STATUS:   "pending",
+		EXPIRES:  now + elevationPendingExpires,
+		CREATED:  now,
+	}
+	query := `
+	INSERT INTO elevations (login, scope, reason, duration, status, approver, decided, expires, created)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := db.Exec(query, rec.LOGIN, rec.SCOPE, rec.REASON, rec.DURATION, rec.STATUS, "", 0, rec.EXPIRES, rec.CREATED)
+	if err != nil {
+		return rec, fmt.Errorf("[Authz.main.createElevation] db.Exec error: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return rec, fmt.Errorf("[Authz.main.createElevation] result.LastInsertId error: %w", err)
+	}
+	rec.ID = uint(id)
+	return rec, nil
+}
+
+// decideElevation approves or denies pending elevation request, approved
+// elevation is active for requested duration starting from its approval
+func decideElevation(db *sql.DB, id uint, approver, status string) (Elevation, error) {
+	rec, err := getElevation(db, id)
+	if err != nil {
+		return rec, err
+	}
+	now := time.Now().Unix()
+	if rec.STATUS != "pending" || rec.EXPIRES < now {
+		return rec, fmt.Errorf("elevation %d is not pending", id)
+	}
+	if rec.LOGIN == approver {
+		return rec, errors.New("users may not decide their own elevation requests")
+	}
+	expires := rec.EXPIRES
+	if status == "approved" {
+		expires = now + rec.DURATION
+	}
+	query := "UPDATE elevations SET status = ?, approver = ?, decided = ?, expires = ? WHERE id = ? AND status = ?"
+	result, err := db.Exec(query, status, approver, now, expires, id, "pending")
+	if err != nil {
+		return rec, fmt.Errorf("[Authz.main.decideElevation] db.Exec error: %w", err)
+	}
+	if nrows, err := result.RowsAffected(); err != nil || nrows != 1 {
+		return rec, fmt.Errorf("elevation %d is already decided", id)
+	}
+	rec.STATUS = status
+	rec.APPROVER = approver
+	rec.DECIDED = now
+	rec.EXPIRES = expires
+	log.Printf("INFO: elevation %d of user %s with scope '%s' is %s by %s", id, rec.LOGIN, rec.SCOPE, status, approver)
+	return rec, nil
+}
+
+// activeElevations returns approved and not expired elevations of given user
+func activeElevations(db *sql.DB, login string) ([]Elevation, error) {
+	query := fmt.Sprintf("SELECT %s FROM elevations WHERE login = ? AND status = ? AND expires > ?", elevationColumns)
+	rows, err := db.Query(query, login, "approved", time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("[Authz.main.activeElevations] db.Query error: %w", err)
+	}
+	defer rows.Close()
+	var records []Elevation
+	for rows.Next() {
+		rec, err := scanElevation(rows)
+		if err != nil {
+			return nil, fmt.Errorf("[Authz.main.activeElevations] rows.Scan error: %w", err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// expireElevations marks expired pending requests and approved elevations as
+// expired, the records are kept in database for the record
+func expireElevations(db *sql.DB) error {
+	query := "UPDATE elevations SET status = ? WHERE status IN (?, ?) AND expires < ?"
+	if _, err := db.Exec(query, "expired", "pending", "approved", time.Now().Unix()); err != nil {
+		return fmt.Errorf("[Authz.main.expireElevations] db.Exec error: %w", err)
+	}
+	return nil
+}
+
+// helper function to check if user is allowed to obtain token with given
+// scope either via scope policy or via active elevations. It returns service
+// error code, expiration time of elevation used to grant the scope (0 if
+// elevation is not used) and error if user is not allowed
+func checkElevatedScope(user, scope string) (int, int64, error) {
+	code, err := checkUserScope(user, scope)
+	if err == nil {
+		return code, 0, nil
+	}
+	elevations, e := activeElevations(_DB, user)
+	if e != nil {
+		log.Println("ERROR:", e)
+		return code, 0, err
+	}
+	var expires int64
+	for _, s := range scopes(scope) {
+		code, err := checkUserScope(user, s)
+		if err == nil {
+			continue
+		}
+		granted := false
+		for _, rec := range elevations {
+			if utils.InList(s, scopes(rec.SCOPE)) {
+				granted = true
+				if expires == 0 || rec.EXPIRES < expires {
+					expires = rec.EXPIRES
+				}
+				break
+			}
+		}
+		if !granted {
+			return code, 0, err
+		}
+	}
+	log.Printf("INFO: user %s is granted scope '%s' via elevation until %s", user, scope, time.Unix(expires, 0))
+	return services.OK, expires, nil
+}
+
+// helper function to check if given user is FOXDEN admin
+func isAdminUser(user string) bool {
+	fuser, err := _foxdenUser.Get(user)
+	return err == nil && utils.InList("foxdenadmin", fuser.Groups)
+}
+
+// helper function to get claims of authorized request
+func requestClaims(c *gin.Context) *authz.Claims {
+	if val, ok := c.Get("claims"); ok {
+		if claims, ok := val.(*authz.Claims); ok {
+			return claims
+		}
+	}
+	return &authz.Claims{}
+}
+
+// ElevationsHandler provides access to GET /elevations end-point, FOXDEN
+// admins see all elevation requests while users only see their own ones
+func ElevationsHandler(c *gin.Context) {
+	claims := requestClaims(c)
+	login := claims.CustomClaims.User
+	if isAdmin(claims) {
+		login = c.Query("user")
+	}
+	records, err := listElevations(_DB, login, c.Query("status"))
+	if err != nil {
+		rec := services.Response("Authz", http.StatusInternalServerError, services.DatabaseError, err)
+		c.JSON(http.StatusInternalServerError, rec)
+		return
+	}
+	c.JSON(http.StatusOK, records)
+}
+
+// CreateElevationHandler provides access to POST /elevations end-point
+func CreateElevationHandler(c *gin.Context) {
+	claims := requestClaims(c)
+	if claims.CustomClaims.User == "" || claims.CustomClaims.Kind == "client" {
+		rec := services.Response("Authz", http.StatusForbidden, services.AuthError, errors.New("user token is required"))
+		c.JSON(http.StatusForbidden, rec)
+		return
+	}
+	var req ElevationRequest
+	defer c.Request.Body.Close()
+	data, err := io.ReadAll(c.Request.Body)
+	if err == nil {
+		err = json.Unmarshal(data, &req)
+	}
+	if err == nil {
+		err = req.validate()
+	}
+	if err != nil {
+		rec := services.Response("Authz", http.StatusBadRequest, services.ValidateError, err)
+		c.JSON(http.StatusBadRequest, rec)
+		return
+	}
+	rec, err := createElevation(_DB, claims.CustomClaims.User, req)
+	if err != nil {
+		rec := services.Response("Authz", http.StatusInternalServerError, services.InsertError, err)
+		c.JSON(http.StatusInternalServerError, rec)
+		return
+	}
+	log.Printf("INFO: user %s requested elevation %d with scope '%s' for %ds, reason: %s", rec.LOGIN, rec.ID, rec.SCOPE, rec.DURATION, rec.REASON)
+	c.JSON(http.StatusOK, rec)
+}
+
+// helper function to define handler which approves or denies elevation request
+func decideElevationHandler(status string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !adminRequest(c) {
+			return
+		}
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			rec := services.Response("Authz", http.StatusBadRequest, services.ParametersError, err)
+			c.JSON(http.StatusBadRequest, rec)
+			return
+		}
+		rec, err := decideElevation(_DB, uint(id), requestClaims(c).CustomClaims.User, status)
+		if err != nil {
+			rec := services.Response("Authz", http.StatusBadRequest, services.UpdateError, err)
+			c.JSON(http.StatusBadRequest, rec)
+			return
+		}
+		c.JSON(http.StatusOK, rec)
+	}
+}
+
+// helper function to render elevation page for given user
+func elevationPage(c *gin.Context, user, msg string) {
+	tmpl := server.MakeTmpl(StaticFs, "Elevation")
+	tmpl["Base"] = srvConfig.Config.Authz.WebServer.Base
+	tmpl["User"] = user
+	tmpl["Message"] = msg
+	tmpl["MaxHours"] = maxElevationDuration() / 3600
+	if records, err := listElevations(_DB, user, ""); err == nil {
+		tmpl["Requests"] = records
+	}
+	if isAdminUser(user) {
+		tmpl["Admin"] = true
+		if records, err := listElevations(_DB, "", "pending"); err == nil {
+			tmpl["Pending"] = records
+		}
+	}
+	header := server.TmplPage(StaticFs, "header.tmpl", tmpl)
+	footer := server.TmplPage(StaticFs, "footer.tmpl", tmpl)
+	content := server.TmplPage(StaticFs, "elevation.tmpl", tmpl)
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(header+content+footer))
+}
+
+// ElevationPageHandler provides access to GET /elevation web page
+func ElevationPageHandler(c *gin.Context) {
+	user, err := sessionUser(c.Request)
+	if err != nil {
+		c.Redirect(http.StatusFound, srvConfig.Config.Authz.WebServer.Base+"/login")
+		return
+	}
+	elevationPage(c, user, "")
+}
+
+// ElevationFormHandler provides access to POST /elevation web form which
+// either files new elevation request or approves/denies pending one
+func ElevationFormHandler(c *gin.Context) {
+	r := c.Request
+	user, err := sessionUser(r)
+	if err != nil {
+		c.Redirect(http.StatusFound, srvConfig.Config.Authz.WebServer.Base+"/login")
+		return
+	}
+	var msg string
+	switch action := r.FormValue("action"); action {
+	case "request":
+		hours, _ := strconv.ParseFloat(r.FormValue("hours"), 64)
+		req := ElevationRequest{
+			Scope:    r.FormValue("scope"),
+			Reason:   r.FormValue("reason"),
+			Duration: int64(hours * 3600),
+		}
+		if err = req.validate(); err == nil {
+			var rec Elevation
+			rec, err = createElevation(_DB, user, req)
+			msg = fmt.Sprintf("elevation request %d is filed", rec.ID)
+		}
+	case "approve", "deny":
+		if !isAdminUser(user) {
+			err = errors.New("admin privileges are required")
+			break
+		}
+		status := "approved"
+		if action == "deny" {
+			status = "denied"
+		}
+		var id uint64
+		id, err = strconv.ParseUint(r.FormValue("id"), 10, 64)
+		if err == nil {
+			_, err = decideElevation(_DB, uint(id), user, status)
+			msg = fmt.Sprintf("elevation request %d is %s", id, status)
+		}
+	default:
+		err = fmt.Errorf("unsupported action '%s'", action)
+	}
+	if err != nil {
+		log.Printf("ERROR: user %s elevation action failed: %v", user, err)
+		msg = err.Error()
+	}
+	elevationPage(c, user, msg)
+}
@@ -0,0 +1,168 @@
+package main
+
+// token exchange module
+//
+// It implements OAuth2 token exchange (RFC 8693) which allows registered
+// FOXDEN services to trade user token for down-scoped and audience
+// restricted token which carries act (actor) claim, such that downstream
+// services know both the user and the service acting on user's behalf.
+//
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	authz "github.com/CHESSComputing/golib/authz"
+	utils "github.com/CHESSComputing/golib/utils"
+	"github.com/gin-gonic/gin"
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// token exchange parameters, see RFC 8693 section 3
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+	jwtTokenType           = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// Actor represents act claim of delegated token, nested actors represent
+// chain of delegation, see RFC 8693 section 4.1
+type Actor struct {
+	Subject string `json:"sub"`
+	Actor   *Actor `json:"act,omitempty"`
+}
+
+// DelegatedClaims represents claims of access token obtained via token exchange
+type DelegatedClaims struct {
+	RealmClaims
+	Actor *Actor `json:"act,omitempty"`
+}
+
+// helper function to check that requested scope is subset of subject token scope
+func exchangeScope(scope, subjectScope string) (string, error) {
+	if scope == "" {
+		return subjectScope, nil
+	}
+	granted := scopes(subjectScope)
+	for _, s := range scopes(scope) {
+		if !utils.InList(s, granted) {
+			return "", fmt.Errorf("scope %s is not granted to subject token", s)
+		}
+	}
+	return scope, nil
+}
+
+// tokenExchangeGrant handles grant_type=urn:ietf:params:oauth:grant-type:token-exchange
+// requests of /oauth/token end-point
+func tokenExchangeGrant(c *gin.Context) {
+	r := c.Request
+	client, err := authenticateConfidentialClient(r)
+	if err != nil {
+		log.Println("ERROR: token exchange:", err)
+		oauthError(c, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+	if !allowClient(c, client) {
+		return
+	}
+	if !client.AllowedGrant(tokenExchangeGrantType) {
+		oauthError(c, http.StatusBadRequest, "unauthorized_client", "client is not allowed to exchange tokens")
+		return
+	}
+	subjectTokenType := r.FormValue("subject_token_type")
+	if subjectTokenType != accessTokenType && subjectTokenType != jwtTokenType {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "unsupported subject_token_type")
+		return
+	}
+	if tokenType := r.FormValue("requested_token_type"); tokenType != "" && tokenType != accessTokenType {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "unsupported requested_token_type")
+		return
+	}
+	audience, err := clientAudience(client, requestAudience(r))
+	if err == nil && len(audience) == 0 {
+		err = errors.New("audience or resource parameter is required")
+	}
+	if err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_target", err.Error())
+		return
+	}
+
+	// validate subject token
+	var subject DelegatedClaims
+	err = parseClaims(r.FormValue("subject_token"), &subject)
+	if err == nil {
+		if revoked, e := isRevoked(_DB, subject.ID); e != nil || revoked {
+			err = errors.New("subject token is revoked")
+		}
+	}
+	if err == nil && subject.CustomClaims.User == "" {
+		err = errors.New("subject token does not belong to a user")
+	}
+	// audience restricted subject token may only be exchanged by its audience
+	if err == nil && len(subject.Audience) > 0 && !utils.InList(client.ID, subject.Audience) {
+		err = fmt.Errorf("subject token is not issued for client %s", client.ID)
+	}
+	if err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+	scope, err := exchangeScope(r.FormValue("scope"), subject.CustomClaims.Scope)
+	if err == nil && !client.AllowedScope(scope) {
+		err = fmt.Errorf("client is not allowed to request scope %s", scope)
+	}
+	if err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_scope", err.Error())
+		return
+	}
+
+	// exchanged token can't outlive subject token
+	expires := int64(3600)
+	if subject.ExpiresAt != nil {
+		if left := int64(time.Until(subject.ExpiresAt.Time) / time.Second); left < expires {
+			expires = left
+		}
+	}
+	user := subject.CustomClaims.User
+	if !allowUser(c, user) {
+		return
+	}
+	auser := authz.AuthUser{
+		Name:    user,
+		Scope:   scope,
+		Kind:    "token_exchange",
+		App:     client.ID,
+		Expires: expires,
+		Btrs:    restrictBtrs(subject.CustomClaims.Btrs, scope),
+		Groups:  subject.CustomClaims.Groups,
+		Scopes:  subject.CustomClaims.Scopes,
+	}
+	claims := DelegatedClaims{
+		// delegated token keeps Kerberos realm of the subject
+		RealmClaims: RealmClaims{Claims: accessTokenClaims(auser), Realm: subject.Realm},
+		Actor:       &Actor{Subject: client.ID, Actor: subject.Actor},
+	}
+	claims.Audience = jwt.ClaimStrings(audience)
+	accessToken, err := signAccessToken(claims)
+	if err != nil {
+		log.Println("ERROR:", err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "unable to issue access token")
+		return
+	}
+	log.Printf("INFO: client %s exchanged token %s of user %s for token %s, audience %s, scope %s",
+		client.ID, subject.ID, user, claims.ID, audience, scope)
+	tmap := TokenMap{
+		TokenMap: authz.TokenMap{
+			AccessToken: accessToken,
+			Scope:       scope,
+			Type:        "bearer",
+			Expires:     expires,
+		},
+		IssuedTokenType: accessTokenType,
+		TokenID:         claims.ID,
+		Audience:        audience,
+	}
+	auditIssued(r, tmap, user, client.ID, scope, "token_exchange")
+	c.JSON(http.StatusOK, tmap)
+}
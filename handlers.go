@@ -43,6 +43,10 @@ var StaticFs embed.FS
 func handleError(c *gin.Context, msg string, err error) {
 	w := c.Writer
 	log.Printf("ERROR: %v\n", err)
+	// mark request as failed for metrics since error page is served with status OK
+	if _, ok := c.Get("failed"); !ok {
+		c.Set("failed", "ErrorPage")
+	}
 	tmpl := server.MakeTmpl(StaticFs, "Error")
 	tmpl["Message"] = strings.ToTitle(msg)
 	page := server.TmplPage(StaticFs, "error.tmpl", tmpl)
@@ -69,8 +73,15 @@ func validToken(c *gin.Context, user, scope string) (oauth2.GrantType, *oauth2.T
 	return gt, tgr, nil
 }
 
-// helper function to generate valid token map
-func tokenMap(user, scope, kind, app string, expires int64) (authz.TokenMap, error) {
+// helper function to generate valid token map, the token may be restricted
+// to given audience
+func tokenMap(user, scope, kind, app string, expires int64, audience ...string) (TokenMap, error) {
+	return realmTokenMap(user, "", scope, kind, app, expires, audience...)
+}
+
+// helper function to generate valid token map of user authenticated in given
+// Kerberos realm, the realm is recorded in token claims
+func realmTokenMap(user, realm, scope, kind, app string, expires int64, audience ...string) (TokenMap, error) {
 	auser := authz.AuthUser{
 		Name:  user,
 		Scope: scope,
@@ -80,23 +91,85 @@ func tokenMap(user, scope, kind, app string, expires int64) (authz.TokenMap, err
 	if kind != "" {
 		auser.Kind = kind
 	}
-	duration := srvConfig.Config.Authz.TokenExpires
-	if expires != 0 {
-		auser.Expires = expires
+	// explicit expiration, e.g. limited by Kerberos ticket or scope elevation,
+	// takes precedence over configured token lifetime
+	if expires == 0 {
+		expires = srvConfig.Config.Authz.TokenExpires
 	}
-	if duration == 0 {
-		auser.Expires = 7200
+	if expires == 0 {
+		expires = 7200
 	}
-	// service_user is set when we perform inter-service requests between FOXDEN servies
-	if user != "" && user != "service_user" && kind != "trusted_client" {
+	auser.Expires = expires
+	// service_user is set when we perform inter-service requests between FOXDEN servies,
+	// and registered clients (kind client) do not have user attributes
+	if user != "" && user != "service_user" && kind != "trusted_client" && kind != "client" {
 		// only check user attributes if user name is provided
 		if fuser, err := _foxdenUser.Get(user); err == nil {
-			auser.Btrs = fuser.Btrs
+			auser.Btrs = restrictBtrs(fuser.Btrs, scope)
 			auser.Groups = fuser.Groups
 			auser.Scopes = fuser.Scopes
 		}
+	} else if btrs := scopeBtrs(scope); len(btrs) > 0 {
+		// BTR scopes of clients are controlled by client registry
+		auser.Btrs = btrs
+	}
+	return newRealmAccessToken(auser, realm, audience...)
+}
+
+// helper function to check if user is allowed to obtain token with given scope,
+// it returns service error code and error if user is not allowed
+func checkUserScope(user, scope string) (int, error) {
+	fuser, err := _foxdenUser.Get(user)
+	if err != nil {
+		msg := fmt.Sprintf("No foxden user found, error: %v", err)
+		return services.LDAPSearchError, errors.New(msg)
 	}
-	return auser.TokenMap()
+	// every requested scope is checked against scope policy and requested
+	// BTRs should belong to the user
+	err = _policy.Check(fuser, scope)
+	if err == nil {
+		err = checkBtrScopes(scope, fuser.Btrs)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("User %s with scope %s is not allowed, %v, user btrs=%+v groups=%+v", user, scope, err, fuser.Btrs, fuser.Groups)
+		return services.LDAPGroupError, errors.New(msg)
+	}
+	return services.OK, nil
+}
+
+// OAuthError represents OAuth2 error response, see RFC 6749 section 5.2
+type OAuthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// helper function to write OAuth2 error response, the denial is recorded in
+// audit log except pending device code responses
+func oauthError(c *gin.Context, status int, code, desc string) {
+	if status == http.StatusInternalServerError {
+		log.Printf("ERROR: %s %s", code, desc)
+	}
+	if code != "authorization_pending" && code != "slow_down" {
+		r := c.Request
+		clientId, _ := clientCredentials(r)
+		auditDenied(r, auditToken, "", clientId, r.FormValue("scope"), r.FormValue("grant_type"),
+			fmt.Errorf("%s: %s", code, desc))
+	}
+	c.Set("failed", code)
+	c.JSON(status, OAuthError{Error: code, Description: desc})
+}
+
+// helper function to write error response of golib service, the service
+// code is recorded as outcome of instrumented handler
+func errorResponse(c *gin.Context, status, srvCode int, err error) {
+	c.Set("failed", serviceCodeName(srvCode))
+	rec := services.Response("Authz", status, srvCode, err)
+	c.AbortWithStatusJSON(status, rec)
+}
+
+// helper function to check if given token claims belong to FOXDEN admin
+func isAdmin(claims *authz.Claims) bool {
+	return utils.InList("foxdenadmin", claims.CustomClaims.Groups)
 }
 
 // AttributesHandler provides access to GET /attrs end-point
@@ -107,33 +180,249 @@ func AttributesHandler(c *gin.Context) {
 		c.JSON(http.StatusOK, fuser)
 		return
 	}
-	rec := services.Response("Authz", http.StatusBadRequest, services.CredentialsError, errors.New("No user attributes"))
-	c.JSON(http.StatusBadRequest, rec)
+	errorResponse(c, http.StatusBadRequest, services.CredentialsError, errors.New("No user attributes"))
 }
 
-// TokenHandler provides access to GET /oauth/token end-point
+// helper function to return grant types supported by /oauth/token end-point
+func supportedGrantTypes() []string {
+	return []string{"client_credentials", "refresh_token", "authorization_code", deviceGrantType, tokenExchangeGrantType}
+}
+
+// TokenHandler provides access to /oauth/token end-point, the OAuth2 grant
+// type is defined by grant_type parameter, and without it we issue
+// client credentials token
 func TokenHandler(c *gin.Context) {
 
 	r := c.Request
-	scope := r.URL.Query().Get("scope")
-	user := r.URL.Query().Get("user")
-	clientId := r.URL.Query().Get("client_id")
-	clientSecret := r.URL.Query().Get("client_secret")
-	if user == "" && clientId == srvConfig.Config.Authz.ClientID && clientSecret == srvConfig.Config.Authz.ClientSecret {
-		user = "service_user"
+	switch grantType := r.FormValue("grant_type"); grantType {
+	case "", "client_credentials":
+	case "refresh_token":
+		refreshTokenGrant(c)
+		return
+	case "authorization_code":
+		authorizationCodeGrant(c)
+		return
+	case deviceGrantType:
+		deviceCodeGrant(c)
+		return
+	case tokenExchangeGrantType:
+		tokenExchangeGrant(c)
+		return
+	default:
+		oauthError(c, http.StatusBadRequest, "unsupported_grant_type", fmt.Sprintf("grant type %s is not supported", grantType))
+		return
+	}
+	// client credentials grant is only available to confidential clients
+	// which are authenticated against client registry
+	client, err := authenticateConfidentialClient(r)
+	if err != nil {
+		log.Printf("ERROR: client authentication failed, IP %s: %v", getIP(r), err)
+		c.Header("WWW-Authenticate", `Basic realm="Authz"`)
+		oauthError(c, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+	if !allowClient(c, client) {
+		return
+	}
+	if !client.AllowedGrant("client_credentials") {
+		oauthError(c, http.StatusBadRequest, "unauthorized_client", "client is not allowed to use client credentials grant")
+		return
+	}
+	scope := r.FormValue("scope")
+	if scope == "" && len(client.Scopes) > 0 {
+		scope = strings.Join(client.Scopes, " ")
 	}
-	tmap, err := tokenMap(user, scope, "client_credentials", "Authz", 0)
-	if Verbose > 2 {
-		log.Println("token map", tmap, err)
+	if !client.AllowedScope(scope) {
+		oauthError(c, http.StatusBadRequest, "invalid_scope", fmt.Sprintf("client is not allowed to request scope %s", scope))
+		return
+	}
+	audience, err := clientAudience(client, requestAudience(r))
+	if err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_target", err.Error())
+		return
+	}
+	// registered clients act on their own behalf, while Authz client may
+	// request token for service user
+	user, kind := client.ID, "client"
+	if client.ID == srvConfig.Config.Authz.ClientID {
+		user, kind = r.FormValue("user"), "client_credentials"
+		if user == "" {
+			user = "service_user"
+		}
+		if !allowUser(c, user) {
+			return
+		}
+		// tokens of FOXDEN users are subject to scope policy
+		if user != "service_user" {
+			if code, err := checkUserScope(user, scope); err != nil {
+				auditDenied(r, auditToken, user, client.ID, scope, kind, err)
+				errorResponse(c, http.StatusBadRequest, code, err)
+				return
+			}
+		}
 	}
+	tmap, err := tokenMap(user, scope, kind, "Authz", 0, audience...)
 	if err != nil {
-		rec := services.Response("Authz", http.StatusBadRequest, services.TokenError, err)
-		c.JSON(http.StatusBadRequest, rec)
+		errorResponse(c, http.StatusBadRequest, services.TokenError, err)
 		return
 	}
+	auditIssued(r, tmap, user, client.ID, scope, kind)
 	c.JSON(http.StatusOK, tmap)
 }
 
+// RevokeHandler provides access to POST /oauth/revoke end-point, see RFC 7009.
+// The token holder may revoke its token by providing it via token parameter,
+// while FOXDEN admins may revoke any token by its ID via jti parameter.
+func RevokeHandler(c *gin.Context) {
+	r := c.Request
+	token := r.FormValue("token")
+	jti := r.FormValue("jti")
+	var user string
+	var expires int64
+	if token != "" {
+		claims, err := parseToken(token)
+		if err != nil {
+			// opaque refresh token revokes its whole token family, according
+			// to RFC 7009 invalid tokens do not cause an error response
+			if rec, rerr := getRefreshToken(_DB, token); rerr == nil {
+				revokeRefreshToken(c, rec)
+				return
+			}
+			log.Println("WARNING: revoke request for invalid token:", err)
+			c.Status(http.StatusOK)
+			return
+		}
+		if claims.ID == "" {
+			errorResponse(c, http.StatusBadRequest, services.TokenError, errors.New("token does not have an ID"))
+			return
+		}
+		jti = claims.ID
+		user = claims.CustomClaims.User
+		if claims.ExpiresAt != nil {
+			expires = claims.ExpiresAt.Unix()
+		}
+	} else if jti != "" {
+		claims, err := parseToken(authz.BearerToken(r))
+		if err != nil || !isAdmin(claims) {
+			msg := "only FOXDEN admin can revoke token by its ID"
+			errorResponse(c, http.StatusUnauthorized, services.AuthError, errors.New(msg))
+			return
+		}
+	} else {
+		errorResponse(c, http.StatusBadRequest, services.ParametersError, errors.New("either token or jti parameter is required"))
+		return
+	}
+	if err := revokeToken(_DB, jti, user, expires); err != nil {
+		errorResponse(c, http.StatusInternalServerError, services.DatabaseError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// Introspection represents token introspection response, see RFC 7662
+type Introspection struct {
+	Active    bool     `json:"active"`
+	Subject   string   `json:"sub,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	Expires   int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	TokenID   string   `json:"jti,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	Btrs      []string `json:"btrs,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+	Kind      string   `json:"kind,omitempty"`
+	Audience  []string `json:"aud,omitempty"`
+	Actor     *Actor   `json:"act,omitempty"`
+	Realm     string   `json:"realm,omitempty"`
+}
+
+// IntrospectHandler provides access to POST /oauth/introspect end-point, see RFC 7662.
+// It is only available to authenticated clients.
+func IntrospectHandler(c *gin.Context) {
+	r := c.Request
+	if _, err := authenticateConfidentialClient(r); err != nil {
+		c.Header("WWW-Authenticate", `Basic realm="Authz"`)
+		errorResponse(c, http.StatusUnauthorized, services.AuthError, err)
+		return
+	}
+	token := r.FormValue("token")
+	if token == "" {
+		errorResponse(c, http.StatusBadRequest, services.ParametersError, errors.New("no token is provided"))
+		return
+	}
+	// invalid, expired or revoked tokens are reported as inactive ones
+	claims := &DelegatedClaims{}
+	err := parseClaims(token, claims)
+	if err != nil {
+		if Verbose > 0 {
+			log.Println("introspect invalid token:", err)
+		}
+		c.JSON(http.StatusOK, Introspection{Active: false})
+		return
+	}
+	if claims.ID != "" {
+		revoked, err := isRevoked(_DB, claims.ID)
+		if err != nil {
+			errorResponse(c, http.StatusInternalServerError, services.DatabaseError, err)
+			return
+		}
+		if revoked {
+			c.JSON(http.StatusOK, Introspection{Active: false})
+			return
+		}
+	}
+	rec := Introspection{
+		Active:    true,
+		Subject:   claims.CustomClaims.User,
+		Username:  claims.CustomClaims.User,
+		Scope:     claims.CustomClaims.Scope,
+		Issuer:    claims.Issuer,
+		TokenID:   claims.ID,
+		TokenType: "bearer",
+		Btrs:      claims.CustomClaims.Btrs,
+		Groups:    claims.CustomClaims.Groups,
+		Kind:      claims.CustomClaims.Kind,
+		Audience:  claims.Audience,
+		Actor:     claims.Actor,
+		Realm:     claims.Realm,
+	}
+	if claims.ExpiresAt != nil {
+		rec.Expires = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		rec.IssuedAt = claims.IssuedAt.Unix()
+	}
+	c.JSON(http.StatusOK, rec)
+}
+
+// RevokedHandler provides access to GET /oauth/revoked end-point which allows
+// FOXDEN services to check revocation status of a token by its ID (jti)
+// or by token itself
+func RevokedHandler(c *gin.Context) {
+	r := c.Request
+	jti := r.URL.Query().Get("jti")
+	if token := r.URL.Query().Get("token"); token != "" {
+		claims, err := parseToken(token)
+		if err != nil {
+			errorResponse(c, http.StatusBadRequest, services.TokenError, err)
+			return
+		}
+		jti = claims.ID
+	}
+	if jti == "" {
+		errorResponse(c, http.StatusBadRequest, services.ParametersError, errors.New("no token ID is provided"))
+		return
+	}
+	revoked, err := isRevoked(_DB, jti)
+	if err != nil {
+		errorResponse(c, http.StatusInternalServerError, services.DatabaseError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"jti": jti, "revoked": revoked})
+}
+
 // LoginHandler handlers Login requests
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	// func LoginHandler(c *gin.Context) {
@@ -150,6 +439,14 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	top := server.TmplPage(StaticFs, "header.tmpl", tmpl)
 	bottom := server.TmplPage(StaticFs, "footer.tmpl", tmpl)
 	tmpl["StartTime"] = time.Now().Unix()
+	// login page may be used by authorization code flow which provides
+	// redirect URL back to authorization end-point
+	tmpl["Redirect"] = loginRedirect(r.URL.Query().Get("redirect"))
+	// device verification page asks user to approve device user code
+	if strings.HasSuffix(r.URL.Path, "/device") {
+		tmpl["Device"] = true
+		tmpl["UserCode"] = r.URL.Query().Get("user_code")
+	}
 	page := server.TmplPage(StaticFs, "login.tmpl", tmpl)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(top + page + bottom))
@@ -164,98 +461,92 @@ func ClientAuthHandler(c *gin.Context) {
 	if srvConfig.Config.Authz.TestMode {
 		tmap, err := tokenMap("testuser", "read+write", "testmode", "Authz", 3600)
 		if err != nil {
-			rec := services.Response("Authz", http.StatusBadRequest, services.TokenError, err)
-			c.JSON(http.StatusBadRequest, rec)
+			errorResponse(c, http.StatusBadRequest, services.TokenError, err)
 			return
 		}
+		auditIssued(r, tmap, "testuser", "", "read+write", "testmode")
 		c.JSON(http.StatusOK, tmap)
 		return
 	}
 
-	var rec authz.Kerberos
+	var rec KerberosRequest
 	defer r.Body.Close()
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
-		rec := services.Response("Authz", http.StatusBadRequest, services.ReaderError, err)
-		c.JSON(http.StatusBadRequest, rec)
+		errorResponse(c, http.StatusBadRequest, services.ReaderError, err)
 		return
 	}
 	err = json.Unmarshal(data, &rec)
 	if err != nil {
-		rec := services.Response("Authz", http.StatusBadRequest, services.UnmarshalError, err)
-		c.JSON(http.StatusBadRequest, rec)
+		errorResponse(c, http.StatusBadRequest, services.UnmarshalError, err)
 		return
 	}
-	creds, err := rec.Credentials()
+	creds, err := kerberosCredentials(r, &rec)
 	if err != nil || creds.Expired() {
-		rec := services.Response("Authz", http.StatusBadRequest, services.CredentialsError, err)
-		c.JSON(http.StatusBadRequest, rec)
+		if err == nil {
+			err = errors.New("expired kerberos credentials")
+		}
+		auditDenied(r, auditToken, rec.User, "", rec.Scope, "kerberos", err)
+		errorResponse(c, http.StatusBadRequest, services.CredentialsError, err)
 		return
 	}
-	if creds.Expired() {
-		rec := services.Response("Authz", http.StatusBadRequest, services.CredentialsError, errors.New("Expired token"))
-		c.JSON(http.StatusBadRequest, rec)
+	// kerberos principal is mapped to FOXDEN user according to its realm
+	user, realm, err := kerberosUser(creds)
+	if err != nil {
+		auditDenied(r, auditToken, rec.User, "", rec.Scope, "kerberos", err)
+		errorResponse(c, http.StatusBadRequest, services.CredentialsError, err)
 		return
 	}
-	if creds.UserName() != rec.User {
-		rec := services.Response("Authz", http.StatusBadRequest, services.CredentialsError, errors.New("User credentials error"))
-		c.JSON(http.StatusBadRequest, rec)
+	if user != rec.User {
+		auditDenied(r, auditToken, rec.User, "", rec.Scope, "kerberos",
+			fmt.Errorf("kerberos credentials belong to user %s", user))
+		errorResponse(c, http.StatusBadRequest, services.CredentialsError, errors.New("User credentials error"))
 		return
 	}
-	/*
-		// check LDAP group for this user
-		if srvConfig.Config.Authz.CheckLDAP {
-			entry, err := ldapCache.Search(srvConfig.Config.LDAP.Login, srvConfig.Config.LDAP.Password, rec.User)
-			if err != nil {
-				msg := fmt.Sprintf("No LDAP entry, error: %v", err)
-				rec := services.Response("Authz", http.StatusBadRequest, services.LDAPSearchError, errors.New(msg))
-				c.JSON(http.StatusBadRequest, rec)
-				return
-			}
-			group := "" // by default all users will have right access privilege
-			if strings.Contains(rec.Scope, "write") {
-				group = "foxdenrw" // for write scope user must be in foxdenrw group
-			} else if strings.Contains(rec.Scope, "delete") {
-				group = "foxdenadmin" // for delete scope user must be in foxdenadmin group
-			}
-			if group != "" && !entry.Belong(group) {
-				msg := fmt.Sprintf("User %s with scope %s is not allowed", rec.User, rec.Scope)
-				rec := services.Response("Authz", http.StatusBadRequest, services.LDAPGroupError, errors.New(msg))
-				c.JSON(http.StatusBadRequest, rec)
-				return
-			}
-		}
-	*/
-	// check user privileges
-	if fuser, err := _foxdenUser.Get(rec.User); err == nil {
-		group := "" // by default all users will have right access privilege
-		if strings.Contains(rec.Scope, "write") {
-			group = "foxdenrw" // for write scope user must be in foxdenrw group
-		} else if strings.Contains(rec.Scope, "delete") {
-			group = "foxdenadmin" // for delete scope user must be in foxdenadmin group
-		}
-		if group != "" && !utils.InList(group, fuser.Groups) {
-			msg := fmt.Sprintf("User %s with scope %s is not allowed, user btrs=%+v groups=%+v", rec.User, rec.Scope, fuser.Btrs, fuser.Groups)
-			rec := services.Response("Authz", http.StatusBadRequest, services.LDAPGroupError, errors.New(msg))
-			c.JSON(http.StatusBadRequest, rec)
-			return
-		}
-	} else {
-		msg := fmt.Sprintf("No foxden user found, error: %v", err)
-		rec := services.Response("Authz", http.StatusBadRequest, services.LDAPSearchError, errors.New(msg))
-		c.JSON(http.StatusBadRequest, rec)
+	if !allowUser(c, user) {
+		return
+	}
+	// token can't outlive kerberos ticket
+	kerberosToken(c, user, realm, rec.Scope, ticketExpires(creds, rec.Expires))
+}
+
+// helper function to issue token of user authenticated in Kerberos realm
+func kerberosToken(c *gin.Context, user, realm, scope string, expires int64) {
+	r := c.Request
+	// check user privileges, the scope may be granted via active elevation
+	// in which case token can't outlive the elevation
+	code, elevated, err := checkElevatedScope(user, scope)
+	if err != nil {
+		auditDenied(r, auditToken, user, "", scope, "kerberos", err)
+		errorResponse(c, http.StatusBadRequest, code, err)
 		return
 	}
+	if elevated > 0 {
+		if left := elevated - time.Now().Unix(); expires == 0 || expires > left {
+			expires = left
+		}
+	}
 
-	tmap, err := tokenMap(rec.User, rec.Scope, "kerberos", "Authz", rec.Expires)
-	if Verbose > 2 {
-		log.Println("token map", tmap, err)
+	// audience is provided via query parameters since request body holds
+	// kerberos credentials
+	audience := requestAudience(r)
+	tmap, err := realmTokenMap(user, realm, scope, "kerberos", "Authz", expires, audience...)
+	// elevated tokens are not refreshable
+	if err == nil && elevated == 0 {
+		err = addRefreshToken(&tmap, "", user, "", scope, "kerberos")
+	}
+	if err == nil {
+		err = addIDToken(&tmap, user, "", "")
 	}
 	if err != nil {
-		rec := services.Response("Authz", http.StatusBadRequest, services.TokenError, err)
-		c.JSON(http.StatusBadRequest, rec)
+		errorResponse(c, http.StatusBadRequest, services.TokenError, err)
 		return
 	}
+	kind := "kerberos"
+	if elevated > 0 {
+		kind = "kerberos (elevated)"
+	}
+	auditIssued(r, tmap, user, "", scope, kind)
 	c.JSON(http.StatusOK, tmap)
 }
 
@@ -273,15 +564,13 @@ func TrustedClientHandler(c *gin.Context) {
 	data, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
-		rec := services.Response("Authz", http.StatusBadRequest, services.ParametersError, err)
-		c.JSON(http.StatusBadRequest, rec)
+		errorResponse(c, http.StatusBadRequest, services.ParametersError, err)
 		return
 	}
 	var rec TrustedClientInfo
 	err = json.Unmarshal(data, &rec)
 	if err != nil {
-		rec := services.Response("Authz", http.StatusBadRequest, services.UnmarshalError, err)
-		c.JSON(http.StatusBadRequest, rec)
+		errorResponse(c, http.StatusBadRequest, services.UnmarshalError, err)
 		return
 	}
 	// using provided trusted client info validate that it is accepted by Authz server based on its TrustedUsers configuration
@@ -298,10 +587,11 @@ func TrustedClientHandler(c *gin.Context) {
 	}
 	if !found {
 		msg := "trusted client info does not match"
-		rec := services.Response("Authz", http.StatusBadRequest, services.AuthError, errors.New(msg))
-		c.JSON(http.StatusBadRequest, rec)
+		auditDenied(r, auditTrusted, rec.User, "", "", "trusted_client", errors.New(msg))
+		errorResponse(c, http.StatusBadRequest, services.AuthError, errors.New(msg))
 		return
 	}
+	audit(r, AuditRecord{EVENT: auditTrusted, OUTCOME: "allow", LOGIN: rec.User, KIND: "trusted_client"})
 	resp := services.Response("Authz", http.StatusOK, services.OK, nil)
 	c.JSON(http.StatusBadRequest, resp)
 }
@@ -315,19 +605,23 @@ func TrustedHandler(c *gin.Context) {
 	edata, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
-		rec := services.Response("Authz", http.StatusBadRequest, services.TokenError, err)
-		c.JSON(http.StatusBadRequest, rec)
+		errorResponse(c, http.StatusBadRequest, services.TokenError, err)
 		return
 	}
-	var t utils.TrustedClient
+	var t TrustedPayload
 	salt := authz.ReadSecret(srvConfig.Config.Encryption.Secret)
 	err = t.Decrypt([]byte(edata), salt)
 	if err != nil {
-		rec := services.Response("Authz", http.StatusBadRequest, services.TokenError, err)
-		c.JSON(http.StatusBadRequest, rec)
+		auditDenied(r, auditTrusted, "", "", "", "trusted_client", err)
+		errorResponse(c, http.StatusBadRequest, services.TokenError, err)
+		return
+	}
+	// reject stale and replayed payloads
+	if err := checkTrustedPayload(r, &t); err != nil {
+		auditDenied(r, auditTrusted, t.User, "", "", "trusted_client", err)
+		errorResponse(c, http.StatusUnauthorized, services.AuthError, err)
 		return
 	}
-
 	// check if user/IP/Mac are matched with our configuration
 	var foundIP, foundMAC string
 	for _, tuser := range srvConfig.Config.TrustedUsers {
@@ -346,28 +640,39 @@ func TrustedHandler(c *gin.Context) {
 	}
 	if foundIP == "" || foundMAC == "" {
 		log.Printf("ERROR: client %+v not found in trusted list", t)
-		rec := services.Response("Authz", http.StatusBadRequest, services.TokenError, errors.New("user not found in trusted list"))
-		c.JSON(http.StatusBadRequest, rec)
+		auditDenied(r, auditTrusted, t.User, "", "read+write", "trusted_client", errors.New("user not found in trusted list"))
+		errorResponse(c, http.StatusBadRequest, services.TokenError, errors.New("user not found in trusted list"))
 		return
 	}
+	// client IP is always checked, local clients (or local reverse proxy which
+	// is not listed in TrustedProxies) resolve to loopback address
 	clientIP := getIP(r)
-	// check if request comes from remote host and skip check for localhost
-	if clientIP != "::1" && foundIP != clientIP {
+	if foundIP != clientIP {
 		log.Printf("ERROR: client IP %s does not match with HTTP IP %s", foundIP, clientIP)
-		rec := services.Response("Authz", http.StatusBadRequest, services.TokenError, errors.New("client IP does not match with HTTP one"))
-		c.JSON(http.StatusBadRequest, rec)
+		auditDenied(r, auditTrusted, t.User, "", "read+write", "trusted_client",
+			fmt.Errorf("client IP %s does not match with HTTP IP %s", foundIP, clientIP))
+		errorResponse(c, http.StatusBadRequest, services.TokenError, errors.New("client IP does not match with HTTP one"))
+		return
+	}
+	if !allowUser(c, t.User) {
+		return
+	}
+	// check trusted user privileges
+	if code, err := checkUserScope(t.User, "read+write"); err != nil {
+		auditDenied(r, auditToken, t.User, "", "read+write", "trusted_client", err)
+		errorResponse(c, http.StatusBadRequest, code, err)
 		return
 	}
 
 	tmap, err := tokenMap(t.User, "read+write", "trusted_client", "Authz", 0)
-	if Verbose > 2 {
-		log.Println("token map", tmap, err)
+	if err == nil {
+		err = addRefreshToken(&tmap, "", t.User, "", "read+write", "trusted_client")
 	}
 	if err != nil {
-		rec := services.Response("Authz", http.StatusBadRequest, services.TokenError, err)
-		c.JSON(http.StatusBadRequest, rec)
+		errorResponse(c, http.StatusBadRequest, services.TokenError, err)
 		return
 	}
+	auditIssued(r, tmap, t.User, "", "read+write", "trusted_client")
 	c.JSON(http.StatusOK, tmap)
 }
 
@@ -388,8 +693,16 @@ func KAuthHandler(c *gin.Context) {
 	password := r.FormValue("password")
 	var creds *credentials.Credentials
 	if name != "" && password != "" {
+		// reject logins of locked out users and IPs before contacting KDC
+		ip := getIP(r)
+		if !checkLockout(c, name, ip) {
+			return
+		}
 		creds, err = kuser(name, password)
+		loginOutcome(name, ip, err == nil && creds != nil)
 		if err != nil {
+			auditDenied(r, auditLogin, name, "", "", "kerberos", err)
+			c.Set("failed", "CredentialsError")
 			msg := "wrong user credentials"
 			handleError(c, msg, err)
 			return
@@ -400,24 +713,52 @@ func KAuthHandler(c *gin.Context) {
 		return
 	}
 	if creds == nil {
+		auditDenied(r, auditLogin, name, "", "", "kerberos", errors.New("no user credentials"))
 		msg := "unable to obtain user credentials"
 		handleError(c, msg, err)
 		return
 	}
+	// kerberos principal is mapped to FOXDEN user according to its realm
+	login := name
+	name, realm, err := kerberosUser(creds)
+	if err != nil {
+		auditDenied(r, auditLogin, login, "", "", "kerberos", err)
+		c.Set("failed", "CredentialsError")
+		handleError(c, "wrong user credentials", err)
+		return
+	}
+	audit(r, AuditRecord{EVENT: auditLogin, OUTCOME: "allow", LOGIN: name, KIND: "kerberos"})
 
-	expiration := time.Now().Add(24 * time.Hour)
-	msg := fmt.Sprintf("%s-%v", creds.UserName(), creds.Authenticated())
-	//     byteArray := encrypt([]byte(msg), Config.StoreSecret)
-	//     n := bytes.IndexByte(byteArray, 0)
-	//     s := string(byteArray[:n])
-	cookie := http.Cookie{Name: "auth-session", Value: msg, Expires: expiration}
-	http.SetCookie(w, &cookie)
-	//     w.WriteHeader(http.StatusFound)
+	// set auth-session cookie with signed session token
+	if err := setSessionCookie(w, r, name); err != nil {
+		msg := "unable to create user session"
+		handleError(c, msg, err)
+		return
+	}
+	// approve device user code if login was initiated by device verification page
+	if userCode := r.FormValue("user_code"); userCode != "" {
+		deviceApproval(c, userCode, name)
+		return
+	}
+	// redirect back to authorization end-point if login was initiated by it
+	if redirect := loginRedirect(r.FormValue("redirect")); redirect != "" {
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
 
-	// get user access token
-	tmap, err := tokenMap(name, "read", "kerberos", "Authz", 0)
-	if Verbose > 2 {
-		log.Println("token map", tmap, err)
+	// check user privileges and get user access token
+	if _, err := checkUserScope(name, "read"); err != nil {
+		auditDenied(r, auditToken, name, "", "read", "kerberos", err)
+		c.Set("failed", "ScopeError")
+		handleError(c, "user is not allowed to obtain token", err)
+		return
+	}
+	tmap, err := realmTokenMap(name, realm, "read", "kerberos", "Authz", 0)
+	if err == nil {
+		err = addIDToken(&tmap, name, "", "")
+	}
+	if err == nil {
+		auditIssued(r, tmap, name, "", "read", "kerberos")
 	}
 	tmpl := server.MakeTmpl(StaticFs, "Login")
 	tmpl["Base"] = srvConfig.Config.Authz.WebServer.Base
@@ -426,7 +767,8 @@ func KAuthHandler(c *gin.Context) {
 	if tmap.AccessToken != "" {
 		token := tmap.AccessToken
 		tmpl["AccessToken"] = token
-		claims, err := authz.TokenClaims(token, srvConfig.Config.Authz.ClientID)
+		tmpl["IDToken"] = tmap.IDToken
+		claims, err := parseToken(token)
 		if err != nil {
 			log.Println("ERROR", err)
 			tmpl["Content"] = err.Error()
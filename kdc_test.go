@@ -0,0 +1,415 @@
+package main
+
+// test KDC module
+//
+// testKDC is in-process stand-in of Kerberos KDC used by handler tests. It
+// serves AS-REQ (without pre-authentication) and TGS-REQ of a single realm
+// over TCP on localhost, keeps user passwords and service keys in memory and
+// provides krb5.conf pointing to itself, generated keytab of Authz service,
+// and helpers to craft tickets and credentials caches with arbitrary validity.
+//
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"gopkg.in/jcmturner/gokrb5.v7/asn1tools"
+	"gopkg.in/jcmturner/gokrb5.v7/crypto"
+	"gopkg.in/jcmturner/gokrb5.v7/iana"
+	"gopkg.in/jcmturner/gokrb5.v7/iana/asnAppTag"
+	"gopkg.in/jcmturner/gokrb5.v7/iana/errorcode"
+	"gopkg.in/jcmturner/gokrb5.v7/iana/etypeID"
+	"gopkg.in/jcmturner/gokrb5.v7/iana/keyusage"
+	"gopkg.in/jcmturner/gokrb5.v7/iana/msgtype"
+	"gopkg.in/jcmturner/gokrb5.v7/iana/nametype"
+	"gopkg.in/jcmturner/gokrb5.v7/iana/patype"
+	"gopkg.in/jcmturner/gokrb5.v7/keytab"
+	"gopkg.in/jcmturner/gokrb5.v7/messages"
+	"gopkg.in/jcmturner/gokrb5.v7/types"
+)
+
+// encryption type of all keys issued by test KDC
+const testEType = etypeID.AES256_CTS_HMAC_SHA1_96
+
+// testKDCRep represents KDC reply (AS-REP or TGS-REP) on the wire, gokrb5
+// only provides its unmarshalling. The ticket is explicitly tagged by hand
+// since asn1 does not wrap raw values into explicit tags
+type testKDCRep struct {
+	PVNO    int                 `asn1:"explicit,tag:0"`
+	MsgType int                 `asn1:"explicit,tag:1"`
+	CRealm  string              `asn1:"generalstring,explicit,tag:3"`
+	CName   types.PrincipalName `asn1:"explicit,tag:4"`
+	Ticket  asn1.RawValue
+	EncPart types.EncryptedData `asn1:"explicit,tag:6"`
+}
+
+// testKDC represents in-process Kerberos KDC
+type testKDC struct {
+	Realm    string
+	Lifetime time.Duration // maximum lifetime of issued tickets
+
+	listener net.Listener
+	keys     map[string]types.EncryptionKey // keys of service principals
+	keytab   *keytab.Keytab                 // keytab of all service principals
+	mutex    sync.Mutex
+	users    map[string]string // passwords of user principals
+}
+
+// newTestKDC starts KDC of given realm with krbtgt and given service
+// principals, the KDC is stopped when test finishes
+func newTestKDC(t *testing.T, realm string, services ...string) *testKDC {
+	t.Helper()
+	kdc := &testKDC{
+		Realm:    realm,
+		Lifetime: time.Hour,
+		keys:     make(map[string]types.EncryptionKey),
+		users:    make(map[string]string),
+	}
+	names := append([]string{"krbtgt/" + realm}, services...)
+	for _, name := range names {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		kdc.keys[name] = types.EncryptionKey{KeyType: testEType, KeyValue: key}
+	}
+	kdc.keytab = kdc.serviceKeytab(t, names...)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kdc.listener = listener
+	go kdc.serve()
+	t.Cleanup(func() { listener.Close() })
+	return kdc
+}
+
+// AddUser adds user principal with given password to KDC
+func (k *testKDC) AddUser(user, password string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.users[user] = password
+}
+
+// Addr returns address of KDC
+func (k *testKDC) Addr() string {
+	return k.listener.Addr().String()
+}
+
+// Krb5Conf writes krb5.conf pointing to KDC into test directory, clients are
+// forced to use TCP since KDC does not serve UDP
+func (k *testKDC) Krb5Conf(t *testing.T) string {
+	t.Helper()
+	enctype := "aes256-cts-hmac-sha1-96"
+	conf := fmt.Sprintf(`[libdefaults]
+ default_realm = %s
+ dns_lookup_kdc = false
+ dns_lookup_realm = false
+ udp_preference_limit = 1
+ default_tkt_enctypes = %s
+ default_tgs_enctypes = %s
+ permitted_enctypes = %s
+
+[realms]
+ %s = {
+  kdc = %s
+ }
+`, k.Realm, enctype, enctype, enctype, k.Realm, k.Addr())
+	fname := filepath.Join(t.TempDir(), "krb5.conf")
+	if err := os.WriteFile(fname, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+// Keytab writes keytab of given service principals into test directory
+func (k *testKDC) Keytab(t *testing.T, services ...string) string {
+	t.Helper()
+	data := k.keytabData(t, services...)
+	fname := filepath.Join(t.TempDir(), "authz.keytab")
+	if err := os.WriteFile(fname, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+// helper function to build keytab of given service principals
+func (k *testKDC) serviceKeytab(t *testing.T, services ...string) *keytab.Keytab {
+	t.Helper()
+	kt := keytab.New()
+	if err := kt.Unmarshal(k.keytabData(t, services...)); err != nil {
+		t.Fatal(err)
+	}
+	return kt
+}
+
+// helper function to encode keytab (version 2) of given service principals,
+// gokrb5 does not allow to create keytab entries
+func (k *testKDC) keytabData(t *testing.T, services ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.Write([]byte{5, 2})
+	for _, name := range services {
+		key, ok := k.keys[name]
+		if !ok {
+			t.Fatalf("unknown service principal %s", name)
+		}
+		var entry bytes.Buffer
+		comps := strings.Split(name, "/")
+		binary.Write(&entry, binary.BigEndian, int16(len(comps)))
+		for _, s := range append([]string{k.Realm}, comps...) {
+			binary.Write(&entry, binary.BigEndian, int16(len(s)))
+			entry.WriteString(s)
+		}
+		binary.Write(&entry, binary.BigEndian, int32(nametype.KRB_NT_SRV_INST))
+		binary.Write(&entry, binary.BigEndian, uint32(time.Now().Unix()))
+		entry.WriteByte(1)
+		binary.Write(&entry, binary.BigEndian, int16(key.KeyType))
+		binary.Write(&entry, binary.BigEndian, int16(len(key.KeyValue)))
+		entry.Write(key.KeyValue)
+		binary.Write(&entry, binary.BigEndian, uint32(1))
+		binary.Write(&buf, binary.BigEndian, int32(entry.Len()))
+		buf.Write(entry.Bytes())
+	}
+	return buf.Bytes()
+}
+
+// Ticket issues ticket of user for service principal with given validity,
+// it does not require KDC exchange and allows to craft expired tickets
+func (k *testKDC) Ticket(t *testing.T, user, service string, start, end time.Time) (messages.Ticket, types.EncryptionKey) {
+	t.Helper()
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, user)
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, service)
+	tkt, key, err := messages.NewTicket(cname, k.Realm, sname, k.Realm, types.NewKrbFlags(),
+		k.keytab, testEType, 1, start, start, end, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tkt, key
+}
+
+// CCache encodes credentials cache (version 4) of user with TGT of given
+// validity, i.e. result of kinit
+func (k *testKDC) CCache(t *testing.T, user string, start, end time.Time) []byte {
+	t.Helper()
+	tgt, key := k.Ticket(t, user, "krbtgt/"+k.Realm, start, end)
+	data, err := tgt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	octets := func(b []byte) {
+		binary.Write(&buf, binary.BigEndian, uint32(len(b)))
+		buf.Write(b)
+	}
+	principal := func(ntype int32, name string) {
+		comps := strings.Split(name, "/")
+		binary.Write(&buf, binary.BigEndian, ntype)
+		binary.Write(&buf, binary.BigEndian, uint32(len(comps)))
+		octets([]byte(k.Realm))
+		for _, s := range comps {
+			octets([]byte(s))
+		}
+	}
+	// header with default principal
+	buf.Write([]byte{5, 4, 0, 0})
+	principal(nametype.KRB_NT_PRINCIPAL, user)
+	// TGT credentials
+	principal(nametype.KRB_NT_PRINCIPAL, user)
+	principal(nametype.KRB_NT_SRV_INST, "krbtgt/"+k.Realm)
+	binary.Write(&buf, binary.BigEndian, int16(key.KeyType))
+	octets(key.KeyValue)
+	for _, ts := range []time.Time{start, start, end, end} {
+		binary.Write(&buf, binary.BigEndian, uint32(ts.Unix()))
+	}
+	buf.WriteByte(0)              // is_skey
+	buf.Write([]byte{0, 0, 0, 0}) // ticket flags
+	buf.Write([]byte{0, 0, 0, 0}) // addresses
+	buf.Write([]byte{0, 0, 0, 0}) // authdata
+	octets(data)                  // ticket
+	octets(nil)                   // second ticket
+	return buf.Bytes()
+}
+
+// helper function to accept KDC connections
+func (k *testKDC) serve() {
+	for {
+		conn, err := k.listener.Accept()
+		if err != nil {
+			return
+		}
+		go k.handle(conn)
+	}
+}
+
+// helper function to serve KDC requests of TCP connection, every message is
+// preceded by its length
+func (k *testKDC) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		req := make([]byte, size)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		rep := k.reply(req)
+		binary.Write(conn, binary.BigEndian, uint32(len(rep)))
+		if _, err := conn.Write(rep); err != nil {
+			return
+		}
+	}
+}
+
+// helper function to process KDC request
+func (k *testKDC) reply(req []byte) []byte {
+	var asReq messages.ASReq
+	if err := asReq.Unmarshal(req); err == nil {
+		return k.asReply(asReq)
+	}
+	var tgsReq messages.TGSReq
+	if err := tgsReq.Unmarshal(req); err == nil {
+		return k.tgsReply(tgsReq)
+	}
+	return k.errorReply(errorcode.KRB_ERR_GENERIC, "unsupported KDC request")
+}
+
+// helper function to process AS-REQ, reply is encrypted with key derived
+// from user password, i.e. client with wrong password can't decrypt it
+func (k *testKDC) asReply(req messages.ASReq) []byte {
+	body := req.ReqBody
+	k.mutex.Lock()
+	password, ok := k.users[body.CName.PrincipalNameString()]
+	k.mutex.Unlock()
+	if !ok || body.Realm != k.Realm {
+		return k.errorReply(errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN, "client principal is unknown")
+	}
+	key, _, err := crypto.GetKeyFromPassword(password, body.CName, k.Realm, testEType, types.PADataSequence{})
+	if err != nil {
+		return k.errorReply(errorcode.KRB_ERR_GENERIC, err.Error())
+	}
+	now := time.Now().UTC()
+	end := k.endTime(now, body.Till)
+	tkt, skey, err := messages.NewTicket(body.CName, k.Realm, body.SName, k.Realm, types.NewKrbFlags(),
+		k.keytab, testEType, 1, now, now, end, end)
+	if err != nil {
+		return k.errorReply(errorcode.KDC_ERR_S_PRINCIPAL_UNKNOWN, err.Error())
+	}
+	enc := k.encPart(skey, body, now, now, end)
+	return k.kdcReply(msgtype.KRB_AS_REP, asnAppTag.ASREP, asnAppTag.EncASRepPart,
+		keyusage.AS_REP_ENCPART, key, body.CName, tkt, enc)
+}
+
+// helper function to process TGS-REQ, the TGT of AP-REQ in its PA-DATA is
+// validated with krbtgt key and its session key encrypts the reply
+func (k *testKDC) tgsReply(req messages.TGSReq) []byte {
+	var apReq messages.APReq
+	for _, pa := range req.PAData {
+		if pa.PADataType == patype.PA_TGS_REQ {
+			if err := apReq.Unmarshal(pa.PADataValue); err != nil {
+				return k.errorReply(errorcode.KRB_ERR_GENERIC, err.Error())
+			}
+		}
+	}
+	if ok, err := apReq.Verify(k.keytab, 5*time.Minute, types.HostAddress{}); !ok {
+		var krbErr messages.KRBError
+		if errors.As(err, &krbErr) {
+			return k.errorReply(krbErr.ErrorCode, krbErr.EText)
+		}
+		return k.errorReply(errorcode.KRB_AP_ERR_BAD_INTEGRITY, fmt.Sprintf("invalid TGT: %v", err))
+	}
+	tgt := apReq.Ticket.DecryptedEncPart
+	body := req.ReqBody
+	now := time.Now().UTC()
+	end := k.endTime(now, body.Till)
+	if end.After(tgt.EndTime) {
+		end = tgt.EndTime
+	}
+	tkt, skey, err := messages.NewTicket(tgt.CName, tgt.CRealm, body.SName, k.Realm, types.NewKrbFlags(),
+		k.keytab, testEType, 1, tgt.AuthTime, now, end, end)
+	if err != nil {
+		return k.errorReply(errorcode.KDC_ERR_S_PRINCIPAL_UNKNOWN, err.Error())
+	}
+	enc := k.encPart(skey, body, tgt.AuthTime, now, end)
+	return k.kdcReply(msgtype.KRB_TGS_REP, asnAppTag.TGSREP, asnAppTag.EncTGSRepPart,
+		keyusage.TGS_REP_ENCPART_SESSION_KEY, tgt.Key, tgt.CName, tkt, enc)
+}
+
+// helper function to limit ticket end time by KDC lifetime
+func (k *testKDC) endTime(now, till time.Time) time.Time {
+	end := now.Add(k.Lifetime)
+	if !till.IsZero() && till.Before(end) {
+		return till
+	}
+	return end
+}
+
+// helper function to create encrypted part of KDC reply
+func (k *testKDC) encPart(key types.EncryptionKey, body messages.KDCReqBody, auth, start, end time.Time) messages.EncKDCRepPart {
+	return messages.EncKDCRepPart{
+		Key:       key,
+		LastReqs:  []messages.LastReq{{LRType: 0, LRValue: auth}},
+		Nonce:     body.Nonce,
+		Flags:     types.NewKrbFlags(),
+		AuthTime:  auth,
+		StartTime: start,
+		EndTime:   end,
+		RenewTill: end,
+		SRealm:    k.Realm,
+		SName:     body.SName,
+	}
+}
+
+// helper function to encode KDC reply
+func (k *testKDC) kdcReply(mtype, tag, encTag int, usage uint32, key types.EncryptionKey,
+	cname types.PrincipalName, tkt messages.Ticket, enc messages.EncKDCRepPart) []byte {
+	data, err := asn1.Marshal(enc)
+	if err != nil {
+		return k.errorReply(errorcode.KRB_ERR_GENERIC, err.Error())
+	}
+	encPart, err := crypto.GetEncryptedData(asn1tools.AddASNAppTag(data, encTag), key, usage, 1)
+	if err != nil {
+		return k.errorReply(errorcode.KRB_ERR_GENERIC, err.Error())
+	}
+	tdata, err := tkt.Marshal()
+	if err != nil {
+		return k.errorReply(errorcode.KRB_ERR_GENERIC, err.Error())
+	}
+	rep := testKDCRep{
+		PVNO:    iana.PVNO,
+		MsgType: mtype,
+		CRealm:  k.Realm,
+		CName:   cname,
+		Ticket:  asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 5, IsCompound: true, Bytes: tdata},
+		EncPart: encPart,
+	}
+	data, err = asn1.Marshal(rep)
+	if err != nil {
+		return k.errorReply(errorcode.KRB_ERR_GENERIC, err.Error())
+	}
+	return asn1tools.AddASNAppTag(data, tag)
+}
+
+// helper function to encode KRB-ERROR reply
+func (k *testKDC) errorReply(code int32, etext string) []byte {
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+k.Realm)
+	krbErr := messages.NewKRBError(sname, k.Realm, code, etext)
+	data, err := asn1.Marshal(krbErr)
+	if err != nil {
+		panic(err)
+	}
+	return asn1tools.AddASNAppTag(data, asnAppTag.KRBError)
+}
@@ -0,0 +1,361 @@
+package main
+
+// Kerberos handlers tests
+//
+// The tests run Authz router against in-process test KDC (see kdc_test.go)
+// and cover password login, AP-REQ and credentials cache logins, SPNEGO and
+// rejection of expired tickets and wrong principals.
+//
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	srvConfig "github.com/CHESSComputing/golib/config"
+	services "github.com/CHESSComputing/golib/services"
+	sqldb "github.com/CHESSComputing/golib/sqldb"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/jcmturner/gokrb5.v7/client"
+	"gopkg.in/jcmturner/gokrb5.v7/config"
+	"gopkg.in/jcmturner/gokrb5.v7/spnego"
+)
+
+// realm, service principal and users of Kerberos tests
+const (
+	testRealm    = "FOXDEN.TEST"
+	testSPN      = "HTTP/authz.test"
+	testUser     = "alice"
+	testPassword = "alice-secret"
+)
+
+// testUsers represents FOXDEN users of Kerberos tests
+type testUsers struct{}
+
+func (u *testUsers) Init()                                    {}
+func (u *testUsers) GetUsers() ([]string, error)              { return []string{testUser, "bob"}, nil }
+func (u *testUsers) GetGroups() ([]string, error)             { return nil, nil }
+func (u *testUsers) GetGroup(did string) string               { return "" }
+func (u *testUsers) GetEmail(user string) (string, error)     { return user + "@foxden.test", nil }
+func (u *testUsers) GetMembers(user string) ([]string, error) { return nil, nil }
+func (u *testUsers) Get(user string) (services.User, error) {
+	if user != testUser && user != "bob" {
+		return services.User{}, os.ErrNotExist
+	}
+	return services.User{Name: user, Scopes: []string{"read"}}, nil
+}
+
+// router is created once since handlers use global state initialized by tests
+var (
+	testRouter     *gin.Engine
+	testRouterOnce sync.Once
+)
+
+// helper function to setup Authz with fresh database, keytab of Authz
+// service and krb5.conf of test KDC
+func setupKerberosTest(t *testing.T) *testKDC {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	kdc := newTestKDC(t, testRealm, testSPN, "HTTP/other.test")
+	kdc.AddUser(testUser, testPassword)
+	kdc.AddUser("bob", "bob-secret")
+
+	srvConfig.Config = &srvConfig.SrvConfig{}
+	srvConfig.Config.Authz.ClientID = "test"
+	srvConfig.Config.Authz.ClientSecret = "secret"
+	srvConfig.Config.Kerberos.Realm = testRealm
+	srvConfig.Config.Kerberos.Krb5Conf = kdc.Krb5Conf(t)
+	srvConfig.Config.Kerberos.Keytab = kdc.Keytab(t, testSPN)
+
+	dir := t.TempDir()
+	db, err := sqldb.InitDB("sqlite3", filepath.Join(dir, "authz.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := os.ReadFile("static/schema/sqlite.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	_DB = db
+	_foxdenUser = &testUsers{}
+	_rateLimiter = &rateLimiter{buckets: make(map[string]*rateBucket)}
+	_policy = defaultPolicy()
+	t.Cleanup(func() {
+		db.Close()
+		_keytab = nil
+	})
+
+	if err := parseConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := initKeytab(); err != nil {
+		t.Fatal(err)
+	}
+	if err := initKeyring(); err != nil {
+		t.Fatal(err)
+	}
+	initOAuthServer()
+	testRouterOnce.Do(func() { testRouter = setupRouter() })
+	return kdc
+}
+
+// helper function to login to test KDC with user password
+func testClient(t *testing.T, user, password string) *client.Client {
+	t.Helper()
+	cfg, err := config.Load(srvConfig.Config.Kerberos.Krb5Conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := client.NewClientWithPassword(user, testRealm, password, cfg, client.DisablePAFXFAST(true))
+	if err := cl.Login(); err != nil {
+		t.Fatal(err)
+	}
+	return cl
+}
+
+// helper function to serve request by Authz router
+func serve(req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	return w
+}
+
+// helper function to post JSON to Authz router
+func postJSON(t *testing.T, path string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	return serve(req)
+}
+
+// helper function to check that response contains access token of user
+// in test realm
+func checkToken(t *testing.T, w *httptest.ResponseRecorder, user string) {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var tmap TokenMap
+	if err := json.Unmarshal(w.Body.Bytes(), &tmap); err != nil {
+		t.Fatal(err)
+	}
+	var claims RealmClaims
+	if err := parseClaims(tmap.AccessToken, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.CustomClaims.User != user || claims.Realm != testRealm {
+		t.Errorf("token of user %s@%s, expected %s@%s", claims.CustomClaims.User, claims.Realm, user, testRealm)
+	}
+}
+
+// helper function to build AP-REQ of user with given ticket
+func testAPReq(t *testing.T, kdc *testKDC, user, service string, start, end time.Time) []byte {
+	t.Helper()
+	cl := client.NewClientWithPassword(user, testRealm, "", config.NewConfig())
+	tkt, key := kdc.Ticket(t, user, service, start, end)
+	token, err := spnego.NewKRB5TokenAPREQ(cl, tkt, key, []int{}, []int{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := token.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// helper function to post password login form to /kauth end-point, it
+// returns session cookie set by successful login
+func kauth(t *testing.T, user, password string) *http.Cookie {
+	t.Helper()
+	form := url.Values{"name": {user}, "password": {password}}
+	req := httptest.NewRequest("POST", "/kauth", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := serve(req)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "auth-session" {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// TestKerberosPasswordLogin tests password login via /kauth end-point
+func TestKerberosPasswordLogin(t *testing.T) {
+	setupKerberosTest(t)
+	if cookie := kauth(t, testUser, testPassword); cookie == nil {
+		t.Error("password login did not create user session")
+	}
+	if cookie := kauth(t, testUser+"@"+testRealm, testPassword); cookie == nil {
+		t.Error("password login with realm did not create user session")
+	}
+	if cookie := kauth(t, testUser, "wrong-password"); cookie != nil {
+		t.Error("password login with wrong password created user session")
+	}
+	if cookie := kauth(t, "mallory", testPassword); cookie != nil {
+		t.Error("password login of unknown principal created user session")
+	}
+	if cookie := kauth(t, testUser+"@OTHER.REALM", testPassword); cookie != nil {
+		t.Error("password login of not allowed realm created user session")
+	}
+}
+
+// TestKerberosAPReq tests token request with AP-REQ obtained from test KDC
+func TestKerberosAPReq(t *testing.T) {
+	kdc := setupKerberosTest(t)
+	cl := testClient(t, testUser, testPassword)
+	apReq, err := KerberosAPReq(cl, testSPN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := KerberosRequest{APReq: apReq}
+	rec.User, rec.Scope = testUser, "read"
+	checkToken(t, postJSON(t, "/oauth/authorize", rec), testUser)
+
+	// authenticator can't be used twice
+	if w := postJSON(t, "/oauth/authorize", rec); w.Code != http.StatusBadRequest {
+		t.Errorf("replayed AP-REQ: unexpected status %d", w.Code)
+	}
+
+	// client-supplied credentials cache is not accepted without AP-REQ
+	now := time.Now().UTC()
+	rec = KerberosRequest{}
+	rec.User, rec.Scope = testUser, "read"
+	rec.Ticket = kdc.CCache(t, testUser, now, now.Add(time.Hour))
+	if w := postJSON(t, "/oauth/authorize", rec); w.Code != http.StatusBadRequest {
+		t.Errorf("request without AP-REQ: unexpected status %d", w.Code)
+	}
+}
+
+// TestKerberosWrongPrincipal tests rejection of tickets of other principals
+func TestKerberosWrongPrincipal(t *testing.T) {
+	kdc := setupKerberosTest(t)
+	now := time.Now().UTC()
+
+	// ticket of bob can't be used to obtain token of alice
+	rec := KerberosRequest{APReq: testAPReq(t, kdc, "bob", testSPN, now, now.Add(time.Hour))}
+	rec.User, rec.Scope = testUser, "read"
+	if w := postJSON(t, "/oauth/authorize", rec); w.Code != http.StatusBadRequest {
+		t.Errorf("AP-REQ of other user: unexpected status %d", w.Code)
+	}
+
+	// ticket of other service is not accepted by Authz keytab
+	cl := testClient(t, testUser, testPassword)
+	apReq, err := KerberosAPReq(cl, "HTTP/other.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = KerberosRequest{APReq: apReq}
+	rec.User, rec.Scope = testUser, "read"
+	if w := postJSON(t, "/oauth/authorize", rec); w.Code != http.StatusBadRequest {
+		t.Errorf("AP-REQ of other service: unexpected status %d", w.Code)
+	}
+
+	// unknown principal can't obtain ticket from KDC
+	cfg, err := config.Load(srvConfig.Config.Kerberos.Krb5Conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory := client.NewClientWithPassword("mallory", testRealm, "secret", cfg, client.DisablePAFXFAST(true))
+	if err := mallory.Login(); err == nil {
+		t.Error("unknown principal obtained TGT from KDC")
+	}
+}
+
+// TestKerberosExpiredTicket tests rejection of expired tickets
+func TestKerberosExpiredTicket(t *testing.T) {
+	kdc := setupKerberosTest(t)
+	now := time.Now().UTC()
+	start, end := now.Add(-2*time.Hour), now.Add(-time.Hour)
+
+	// expired service ticket
+	rec := KerberosRequest{APReq: testAPReq(t, kdc, testUser, testSPN, start, end)}
+	rec.User, rec.Scope = testUser, "read"
+	if w := postJSON(t, "/oauth/authorize", rec); w.Code != http.StatusBadRequest {
+		t.Errorf("expired AP-REQ: unexpected status %d", w.Code)
+	}
+
+	// credentials cache with expired TGT
+	req := CCacheRequest{User: testUser, Scope: "read", CCache: kdc.CCache(t, testUser, start, end)}
+	if w := postJSON(t, "/oauth/ccache", req); w.Code != http.StatusUnauthorized {
+		t.Errorf("expired ccache: unexpected status %d", w.Code)
+	}
+
+	// token can't outlive kerberos ticket, Authz.TokenExpires is not set
+	// and default token lifetime is longer than the ticket
+	if srvConfig.Config.Authz.TokenExpires != 0 {
+		t.Fatal("Authz.TokenExpires is set")
+	}
+	kdc.Lifetime = 10 * time.Minute
+	cl := testClient(t, testUser, testPassword)
+	apReq, err := KerberosAPReq(cl, testSPN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = KerberosRequest{APReq: apReq}
+	rec.User, rec.Scope, rec.Expires = testUser, "read", 3600
+	w := postJSON(t, "/oauth/authorize", rec)
+	checkToken(t, w, testUser)
+	var tmap TokenMap
+	if err := json.Unmarshal(w.Body.Bytes(), &tmap); err != nil {
+		t.Fatal(err)
+	}
+	if tmap.Expires > int64(kdc.Lifetime.Seconds()) {
+		t.Errorf("token expires in %d seconds after kerberos ticket", tmap.Expires)
+	}
+}
+
+// TestKerberosCCache tests token request with credentials cache
+func TestKerberosCCache(t *testing.T) {
+	kdc := setupKerberosTest(t)
+	now := time.Now().UTC()
+	req := CCacheRequest{Scope: "read", CCache: kdc.CCache(t, testUser, now, now.Add(time.Hour))}
+	checkToken(t, postJSON(t, "/oauth/ccache", req), testUser)
+
+	// credentials cache of alice can't be used to obtain token of bob
+	req.User = "bob"
+	if w := postJSON(t, "/oauth/ccache", req); w.Code != http.StatusUnauthorized {
+		t.Errorf("ccache of other user: unexpected status %d", w.Code)
+	}
+}
+
+// TestKerberosNegotiate tests SPNEGO authentication
+func TestKerberosNegotiate(t *testing.T) {
+	setupKerberosTest(t)
+
+	// request without Negotiate header is challenged
+	w := serve(httptest.NewRequest("GET", "/oauth/negotiate", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Negotiate" {
+		t.Errorf("unexpected challenge %d %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+
+	cl := testClient(t, testUser, testPassword)
+	req := httptest.NewRequest("GET", "/oauth/negotiate?scope=read", nil)
+	if err := spnego.SetSPNEGOHeader(cl, req, testSPN); err != nil {
+		t.Fatal(err)
+	}
+	checkToken(t, serve(req), testUser)
+
+	// SPNEGO token of other service is rejected
+	req = httptest.NewRequest("GET", "/oauth/negotiate?scope=read", nil)
+	if err := spnego.SetSPNEGOHeader(cl, req, "HTTP/other.test"); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(req); w.Code != http.StatusUnauthorized {
+		t.Errorf("SPNEGO token of other service: unexpected status %d", w.Code)
+	}
+}
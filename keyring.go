@@ -0,0 +1,413 @@
+package main
+
+// keyring module
+//
+// Keyring holds asymmetric keys (RS256, ES256 or EdDSA) used to sign tokens.
+// Every key has an unique key ID (kid) which is set in JWT header, and it
+// passes through the following states:
+// - next: key is published in JWKS but it is not used for signing yet
+// - active: key is used to sign new tokens
+// - retired: key is published in JWKS to validate already issued tokens
+// The keys are stored on disk in keyring directory as PEM files along with
+// keyring.json metadata file. The scheduled rotation publishes next key
+// KeyPublishAhead seconds before it becomes active, such that services which
+// cache our JWKS have time to fetch new public key before we switch.
+//
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	utils "github.com/CHESSComputing/golib/utils"
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// _keyring holds Authz signing keys
+var _keyring *Keyring
+
+// Key represents signing key of the keyring
+type Key struct {
+	Kid       string `json:"kid"`
+	Alg       string `json:"alg"`       // RS256, ES256 or EdDSA
+	Status    string `json:"status"`    // next, active or retired
+	Created   int64  `json:"created"`   // creation time
+	Activates int64  `json:"activates"` // time when key becomes active
+	Retired   int64  `json:"retired"`   // time when key was retired
+	signer    crypto.Signer
+}
+
+// Keyring represents set of signing keys
+type Keyring struct {
+	Dir   string // keyring directory, if empty keys are kept in memory only
+	Alg   string // algorithm of new keys
+	Keys  []*Key
+	mutex sync.RWMutex
+}
+
+// helper function to generate private key for given algorithm
+func generateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case "RS256":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EdDSA":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported signing algorithm %s", alg)
+}
+
+// helper function to return JWT signing method of given algorithm
+func signingMethod(alg string) jwt.SigningMethod {
+	switch alg {
+	case "RS256":
+		return jwt.SigningMethodRS256
+	case "ES256":
+		return jwt.SigningMethodES256
+	case "EdDSA":
+		return jwt.SigningMethodEdDSA
+	}
+	return nil
+}
+
+// helper function to create new key, the key ID is hash of its public key
+func newKey(alg, status string, activates int64) (*Key, error) {
+	signer, err := generateKey(alg)
+	if err != nil {
+		return nil, fmt.Errorf("[Authz.main.newKey] generateKey error: %w", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, fmt.Errorf("[Authz.main.newKey] x509.MarshalPKIXPublicKey error: %w", err)
+	}
+	hash := sha256.Sum256(der)
+	key := &Key{
+		Kid:       base64.RawURLEncoding.EncodeToString(hash[:16]),
+		Alg:       alg,
+		Status:    status,
+		Created:   time.Now().Unix(),
+		Activates: activates,
+		signer:    signer,
+	}
+	return key, nil
+}
+
+// JWK returns public part of the key as JSON Web Key
+func (k *Key) JWK() JWK {
+	jwk := JWK{Kid: k.Kid, Alg: k.Alg, Use: "sig"}
+	switch pub := k.signer.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	}
+	return jwk
+}
+
+// helper function to return path of key file
+func (k *Keyring) keyFile(kid string) string {
+	return filepath.Join(k.Dir, kid+".pem")
+}
+
+// helper function to load keyring from its directory
+func (k *Keyring) load() error {
+	if k.Dir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(k.Dir, "keyring.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("[Authz.main.Keyring.load] os.ReadFile error: %w", err)
+	}
+	var keys []*Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("[Authz.main.Keyring.load] json.Unmarshal error: %w", err)
+	}
+	for _, key := range keys {
+		data, err := os.ReadFile(k.keyFile(key.Kid))
+		if err != nil {
+			return fmt.Errorf("[Authz.main.Keyring.load] os.ReadFile error: %w", err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("[Authz.main.Keyring.load] unable to decode key %s", key.Kid)
+		}
+		pkey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("[Authz.main.Keyring.load] x509.ParsePKCS8PrivateKey error: %w", err)
+		}
+		signer, ok := pkey.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("[Authz.main.Keyring.load] key %s is not a signing key", key.Kid)
+		}
+		key.signer = signer
+	}
+	k.Keys = keys
+	return nil
+}
+
+// helper function to save keyring to its directory, we write key files
+// before metadata file to never reference non-existing key
+func (k *Keyring) save() error {
+	if k.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(k.Dir, 0700); err != nil {
+		return fmt.Errorf("[Authz.main.Keyring.save] os.MkdirAll error: %w", err)
+	}
+	for _, key := range k.Keys {
+		fname := k.keyFile(key.Kid)
+		if _, err := os.Stat(fname); err == nil {
+			continue
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key.signer)
+		if err != nil {
+			return fmt.Errorf("[Authz.main.Keyring.save] x509.MarshalPKCS8PrivateKey error: %w", err)
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(fname, data, 0600); err != nil {
+			return fmt.Errorf("[Authz.main.Keyring.save] os.WriteFile error: %w", err)
+		}
+	}
+	data, err := json.MarshalIndent(k.Keys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("[Authz.main.Keyring.save] json.MarshalIndent error: %w", err)
+	}
+	tmp := filepath.Join(k.Dir, "keyring.json.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("[Authz.main.Keyring.save] os.WriteFile error: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(k.Dir, "keyring.json")); err != nil {
+		return fmt.Errorf("[Authz.main.Keyring.save] os.Rename error: %w", err)
+	}
+	return nil
+}
+
+// helper function to load keyring, it creates an active key if keyring does not have one
+func loadKeyring(dir, alg string) (*Keyring, error) {
+	if signingMethod(alg) == nil {
+		return nil, fmt.Errorf("[Authz.main.loadKeyring] unsupported signing algorithm %s", alg)
+	}
+	if dir == "" {
+		log.Println("WARNING: Authz.Keyring is not set, will use ephemeral keys to sign tokens")
+	}
+	k := &Keyring{Dir: dir, Alg: alg}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	if k.Active() == nil {
+		key, err := newKey(alg, "active", time.Now().Unix())
+		if err != nil {
+			return nil, err
+		}
+		k.Keys = append(k.Keys, key)
+		if err := k.save(); err != nil {
+			return nil, err
+		}
+		log.Printf("INFO: created new %s signing key %s", key.Alg, key.Kid)
+	}
+	return k, nil
+}
+
+// Active returns active signing key
+func (k *Keyring) Active() *Key {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	for _, key := range k.Keys {
+		if key.Status == "active" {
+			return key
+		}
+	}
+	return nil
+}
+
+// Lookup returns key with given key ID
+func (k *Keyring) Lookup(kid string) *Key {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	for _, key := range k.Keys {
+		if key.Kid == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+// JWKS returns public keys of the keyring
+func (k *Keyring) JWKS() JWKS {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	keys := JWKS{Keys: []JWK{}}
+	for _, key := range k.Keys {
+		keys.Keys = append(keys.Keys, key.JWK())
+	}
+	return keys
+}
+
+// Algorithms returns list of signing algorithms of the keyring
+func (k *Keyring) Algorithms() []string {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	var algs []string
+	for _, key := range k.Keys {
+		if !utils.InList(key.Alg, algs) {
+			algs = append(algs, key.Alg)
+		}
+	}
+	return algs
+}
+
+// Rotate performs scheduled key rotation:
+// - publish next key publishAhead seconds before rotation time
+// - activate next key and retire active one when rotation time is reached
+// - remove retired keys older than retention seconds
+func (k *Keyring) Rotate(rotation, publishAhead, retention int64) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	// pick up changes made by other Authz instances sharing keyring directory
+	if err := k.load(); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	var active, next *Key
+	for _, key := range k.Keys {
+		if key.Status == "active" {
+			active = key
+		} else if key.Status == "next" {
+			next = key
+		}
+	}
+	if active == nil {
+		return errors.New("[Authz.main.Keyring.Rotate] keyring does not have active key")
+	}
+	changed := false
+	rotateAt := active.Activates + rotation
+	if next == nil && now >= rotateAt-publishAhead {
+		// if we missed publishing window we still give clients publishAhead time
+		activates := rotateAt
+		if activates < now+publishAhead {
+			activates = now + publishAhead
+		}
+		key, err := newKey(k.Alg, "next", activates)
+		if err != nil {
+			return err
+		}
+		k.Keys = append(k.Keys, key)
+		changed = true
+		log.Printf("INFO: published next %s signing key %s, it will be activated at %s",
+			key.Alg, key.Kid, time.Unix(activates, 0).Format(time.RFC3339))
+	} else if next != nil && now >= next.Activates {
+		active.Status = "retired"
+		active.Retired = now
+		next.Status = "active"
+		changed = true
+		log.Printf("INFO: activated signing key %s, retired signing key %s", next.Kid, active.Kid)
+	}
+	var keys []*Key
+	for _, key := range k.Keys {
+		if key.Status == "retired" && key.Retired+retention < now {
+			if k.Dir != "" {
+				if err := os.Remove(k.keyFile(key.Kid)); err != nil {
+					log.Println("ERROR: unable to remove key file", err)
+				}
+			}
+			changed = true
+			log.Printf("INFO: removed retired signing key %s", key.Kid)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	k.Keys = keys
+	if changed {
+		return k.save()
+	}
+	return nil
+}
+
+// helper function to sign given claims with active key of the keyring
+func signToken(claims jwt.Claims) (string, error) {
+	if _keyring == nil {
+		return "", errors.New("[Authz.main.signToken] keyring is not initialized")
+	}
+	key := _keyring.Active()
+	if key == nil {
+		return "", errors.New("[Authz.main.signToken] keyring does not have active key")
+	}
+	token := jwt.NewWithClaims(signingMethod(key.Alg), claims)
+	token.Header["kid"] = key.Kid
+	signedToken, err := token.SignedString(key.signer)
+	if err != nil {
+		return "", fmt.Errorf("[Authz.main.signToken] token.SignedString error: %w", err)
+	}
+	return signedToken, nil
+}
+
+// helper function to find public key of given token
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" || _keyring == nil {
+		return nil, errors.New("token does not have kid header")
+	}
+	key := _keyring.Lookup(kid)
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+	if token.Method.Alg() != key.Alg {
+		return nil, fmt.Errorf("signing method %s does not match key %s", token.Method.Alg(), kid)
+	}
+	return key.signer.Public(), nil
+}
+
+// helper function to periodically rotate signing keys
+func keyRotation(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		err := _keyring.Rotate(_config.KeyRotation, _config.KeyPublishAhead, _config.KeyRetention)
+		if err != nil {
+			log.Println("ERROR:", err)
+		}
+	}
+}
+
+// helper function to initialize Authz keyring, id tokens are always signed
+// by keyring keys while access tokens only if Authz.SigningAlg is set
+func initKeyring() error {
+	alg := _config.SigningAlg
+	if alg == "" {
+		alg = "RS256"
+	}
+	keyring, err := loadKeyring(_config.Keyring, alg)
+	if err != nil {
+		return err
+	}
+	_keyring = keyring
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+// keyring tests
+//
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	authz "github.com/CHESSComputing/golib/authz"
+)
+
+// helper function to setup Authz with keyring in given directory which is
+// used to sign access tokens
+func setupKeyringTest(t *testing.T, dir, alg string) *Keyring {
+	t.Helper()
+	setupKerberosTest(t)
+	keyring, err := loadKeyring(dir, alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_keyring = keyring
+	_config.SigningAlg = alg
+	t.Cleanup(func() { _config.SigningAlg = "" })
+	return keyring
+}
+
+// helper function to issue access token signed by active keyring key
+func testKeyringToken(t *testing.T) string {
+	t.Helper()
+	tmap, err := newAccessToken(authz.AuthUser{Name: testUser, Scope: "read", Kind: "user", App: "Authz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tmap.AccessToken
+}
+
+// helper function to return key IDs published in JWKS of the keyring
+func jwksKids(k *Keyring) []string {
+	var kids []string
+	for _, jwk := range k.JWKS().Keys {
+		kids = append(kids, jwk.Kid)
+	}
+	return kids
+}
+
+// helper function to return status of key with given ID
+func keyStatus(k *Keyring, kid string) string {
+	if key := k.Lookup(kid); key != nil {
+		return key.Status
+	}
+	return ""
+}
+
+// TestKeyringRotation tests that rotation moves keys through next, active
+// and retired states, and that tokens signed before rotation are still
+// validated while their key is retired
+func TestKeyringRotation(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keyring")
+	keyring := setupKeyringTest(t, dir, "ES256")
+	first := keyring.Active()
+	if first == nil {
+		t.Fatal("keyring does not have active key")
+	}
+	token := testKeyringToken(t)
+
+	// rotation time is reached, next key is published but not used yet
+	if err := keyring.Rotate(0, 0, 3600); err != nil {
+		t.Fatal(err)
+	}
+	if len(keyring.Keys) != 2 || keyring.Active().Kid != first.Kid {
+		t.Fatalf("unexpected keys after publishing next key: %+v", keyring.Keys)
+	}
+	var second string
+	for _, key := range keyring.Keys {
+		if key.Status == "next" {
+			second = key.Kid
+		}
+	}
+	if second == "" {
+		t.Fatal("next key is not published")
+	}
+	if kids := jwksKids(keyring); len(kids) != 2 {
+		t.Errorf("JWKS does not publish next key: %v", kids)
+	}
+
+	// next key is activated and active key is retired
+	if err := keyring.Rotate(0, 0, 3600); err != nil {
+		t.Fatal(err)
+	}
+	if s := keyStatus(keyring, second); s != "active" {
+		t.Fatalf("next key %s has status %s after rotation", second, s)
+	}
+	if s := keyStatus(keyring, first.Kid); s != "retired" {
+		t.Fatalf("active key %s has status %s after rotation", first.Kid, s)
+	}
+	if kids := jwksKids(keyring); len(kids) != 2 {
+		t.Errorf("JWKS does not publish retired key: %v", kids)
+	}
+	if _, err := parseToken(token); err != nil {
+		t.Errorf("token signed by retired key is rejected: %v", err)
+	}
+	if claims, err := parseToken(testKeyringToken(t)); err != nil {
+		t.Errorf("token signed by new active key is rejected: %v", err)
+	} else if claims.ID == "" {
+		t.Error("token signed by new active key does not have id")
+	}
+
+	// keyring is reloaded from keyring.json with the same key states
+	reloaded, err := loadKeyring(dir, "ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.Keys) != 2 || keyStatus(reloaded, first.Kid) != "retired" || keyStatus(reloaded, second) != "active" {
+		t.Fatalf("unexpected keys of reloaded keyring: %+v", reloaded.Keys)
+	}
+	_keyring = reloaded
+	if _, err := parseToken(token); err != nil {
+		t.Errorf("token signed by retired key is rejected by reloaded keyring: %v", err)
+	}
+
+	// retired key is removed after retention period
+	reloaded.Lookup(first.Kid).Retired = time.Now().Unix() - 7200
+	if err := reloaded.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.Rotate(86400, 3600, 3600); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Lookup(first.Kid) != nil {
+		t.Fatalf("retired key %s is not removed", first.Kid)
+	}
+	if _, err := os.Stat(reloaded.keyFile(first.Kid)); !os.IsNotExist(err) {
+		t.Errorf("key file of removed key %s exists: %v", first.Kid, err)
+	}
+	if kids := jwksKids(reloaded); len(kids) != 1 || kids[0] != second {
+		t.Errorf("unexpected JWKS after removal of retired key: %v", kids)
+	}
+	if _, err := parseToken(token); err == nil {
+		t.Error("token signed by removed key is accepted")
+	}
+}
+
+// TestKeyringEphemeral tests that keyring without directory uses in-memory
+// keys which are rotated without touching the disk
+func TestKeyringEphemeral(t *testing.T) {
+	keyring := setupKeyringTest(t, "", "EdDSA")
+	if keyring.Active() == nil {
+		t.Fatal("ephemeral keyring does not have active key")
+	}
+	token := testKeyringToken(t)
+	for i := 0; i < 2; i++ {
+		if err := keyring.Rotate(0, 0, 3600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(keyring.Keys) != 2 || keyring.Active().Kid == keyring.Keys[0].Kid {
+		t.Fatalf("unexpected keys of rotated ephemeral keyring: %+v", keyring.Keys)
+	}
+	if _, err := parseToken(token); err != nil {
+		t.Errorf("token signed by retired ephemeral key is rejected: %v", err)
+	}
+	if err := keyring.load(); err != nil || len(keyring.Keys) != 2 {
+		t.Errorf("ephemeral keyring is reloaded from disk: %v", err)
+	}
+	if _, err := loadKeyring("", "HS256"); err == nil {
+		t.Error("keyring accepts unsupported signing algorithm")
+	}
+}
@@ -6,12 +6,13 @@ package main
 //
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
-	srvConfig "github.com/CHESSComputing/golib/config"
 	"gopkg.in/jcmturner/gokrb5.v7/client"
-	"gopkg.in/jcmturner/gokrb5.v7/config"
 	"gopkg.in/jcmturner/gokrb5.v7/credentials"
 )
 
@@ -41,30 +42,24 @@ func username(r *http.Request) (string, error) {
 	user := arr[0]
 	return user, nil
 }
+*/
 
-// https://github.com/jcmturner/gokrb5/issues/7
-func kuserFromCache(cacheFile string) (*credentials.Credentials, error) {
-	cfg, err := config.Load(srvConfig.Config.Kerberos.Krb5Conf)
-	ccache, err := credentials.LoadCCache(cacheFile)
-	client, err := client.NewClientFromCCache(ccache, cfg)
-	err = client.Login()
+// helper function to perform kerberos authentication, the login may
+// contain realm (user@REALM), otherwise user belongs to default realm
+func kuser(login, password string) (*credentials.Credentials, error) {
+	start := time.Now()
+	user, realm, err := splitLogin(login)
 	if err != nil {
-		return nil, fmt.Errorf("[Authz.main.kuserFromCache] client.Login error: %w", err)
+		return nil, fmt.Errorf("[Authz.main.kuser] splitLogin error: %w", err)
 	}
-	return client.Credentials, nil
-
-}
-*/
-
-// helper function to perform kerberos authentication
-func kuser(user, password string) (*credentials.Credentials, error) {
-	cfg, err := config.Load(srvConfig.Config.Kerberos.Krb5Conf)
+	cfg, err := realm.krb5Config()
 	if err != nil {
 		log.Printf("reading krb5.conf failes, error %v\n", err)
-		return nil, fmt.Errorf("[Authz.main.kuser] config.Load error: %w", err)
+		return nil, fmt.Errorf("[Authz.main.kuser] krb5Config error: %w", err)
 	}
-	client := client.NewClientWithPassword(user, srvConfig.Config.Kerberos.Realm, password, cfg, client.DisablePAFXFAST(true))
+	client := client.NewClientWithPassword(user, realm.Realm, password, cfg, client.DisablePAFXFAST(true))
 	err = client.Login()
+	observeCall(_metrics.KDC, start, err)
 	if err != nil {
 		log.Printf("client login fails, error %v\n", err)
 		return nil, fmt.Errorf("[Authz.main.kuser] client.Login error: %w", err)
@@ -72,46 +67,101 @@ func kuser(user, password string) (*credentials.Credentials, error) {
 	return client.Credentials, nil
 }
 
-/*
-// authentication function
-func auth(r *http.Request) error {
-	_, err := username(r)
-	return fmt.Errorf("[Authz.main.auth] username error: %w", err)
+// helper function to return service principal of Authz keytab
+func servicePrincipal() (string, error) {
+	if _keytab == nil || len(_keytab.Entries) == 0 {
+		return "", errors.New("kerberos keytab of Authz service is not configured")
+	}
+	return strings.Join(_keytab.Entries[0].Principal.Components, "/"), nil
+}
+
+// helper function to parse credentials cache, gokrb5 parser does not check
+// boundaries of malformed data and panics
+func parseCCache(data []byte) (ccache *credentials.CCache, err error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty kerberos credentials cache")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			ccache, err = nil, fmt.Errorf("[Authz.main.parseCCache] malformed kerberos credentials cache: %v", r)
+		}
+	}()
+	ccache = new(credentials.CCache)
+	if err := ccache.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("[Authz.main.parseCCache] ccache.Unmarshal error: %w", err)
+	}
+	return ccache, nil
 }
 
-// helper function to check user credentials for POST requests
-func getUserCredentials(r *http.Request) (*credentials.Credentials, error) {
-	var msg string
-	// user didn't use web interface, we switch to POST form
-	//     name := r.FormValue("name")
-	ticket := r.FormValue("ticket")
-	fname := fmt.Sprintf("krb-%d", time.Now().UnixNano())
-	tmpFile, err := ioutil.TempFile("/tmp", fname)
+// helper function to perform kerberos authentication with credentials cache,
+// the cache is parsed in memory and its TGT is used to obtain service ticket
+// of Authz from KDC of its realm, which is validated with Authz keytab
+func kuserFromCCache(data []byte) (*credentials.Credentials, error) {
+	ccache, err := parseCCache(data)
 	if err != nil {
-		msg = fmt.Sprintf("Unable to create tempfile: %v", err)
-		log.Printf("ERROR: %s", msg)
-		return nil, errors.New(msg)
+		return nil, err
 	}
-	defer os.Remove(tmpFile.Name())
-	_, err = tmpFile.Write([]byte(ticket))
+	realm, err := findRealm(ccache.DefaultPrincipal.Realm)
 	if err != nil {
-		msg = "unable to write kerberos ticket"
-		log.Printf("ERROR: %s", msg)
-		return nil, errors.New(msg)
+		return nil, err
 	}
-	err = tmpFile.Close()
-	creds, err := kuserFromCache(tmpFile.Name())
+	cfg, err := realm.krb5Config()
 	if err != nil {
-		msg = "wrong user credentials"
-		log.Printf("ERROR: %s", msg)
-		return nil, errors.New(msg)
+		return nil, err
 	}
-	if creds == nil {
-		msg = "unable to obtain user credentials"
-		log.Printf("ERROR: %s", msg)
-		return nil, errors.New(msg)
+	spn, err := servicePrincipal()
+	if err != nil {
+		return nil, err
+	}
+	cl, err := client.NewClientFromCCache(ccache, cfg, client.DisablePAFXFAST(true))
+	if err != nil {
+		return nil, fmt.Errorf("[Authz.main.kuserFromCCache] client.NewClientFromCCache error: %w", err)
+	}
+	defer cl.Destroy()
+	// client from credentials cache only checks that its TGT is not expired
+	if err := cl.Login(); err != nil {
+		return nil, fmt.Errorf("[Authz.main.kuserFromCCache] client.Login error: %w", err)
+	}
+	start := time.Now()
+	tkt, _, err := cl.GetServiceTicket(spn)
+	observeCall(_metrics.KDC, start, err)
+	if err != nil {
+		return nil, fmt.Errorf("[Authz.main.kuserFromCCache] client.GetServiceTicket error: %w", err)
+	}
+	if err := tkt.DecryptEncPart(_keytab, &tkt.SName); err != nil {
+		return nil, fmt.Errorf("[Authz.main.kuserFromCCache] tkt.DecryptEncPart error: %w", err)
+	}
+	if ok, err := tkt.Valid(clockSkew()); !ok {
+		return nil, fmt.Errorf("[Authz.main.kuserFromCCache] tkt.Valid error: %v", err)
+	}
+	enc := tkt.DecryptedEncPart
+	if !enc.CName.Equal(cl.Credentials.CName()) || enc.CRealm != realm.Realm {
+		return nil, errors.New("kerberos service ticket does not belong to credentials cache principal")
 	}
+	creds := credentials.NewFromPrincipalName(enc.CName, enc.CRealm)
+	creds.SetAuthTime(enc.AuthTime)
+	creds.SetAuthenticated(true)
+	creds.SetValidUntil(enc.EndTime)
 	return creds, nil
 }
 
+// helper function to limit token expiration (in seconds) by validity of
+// kerberos credentials
+func ticketExpires(creds *credentials.Credentials, expires int64) int64 {
+	until := creds.ValidUntil()
+	if until.IsZero() {
+		return expires
+	}
+	if left := int64(time.Until(until).Seconds()); expires == 0 || expires > left {
+		return left
+	}
+	return expires
+}
+
+/*
+// authentication function
+func auth(r *http.Request) error {
+	_, err := username(r)
+	return fmt.Errorf("[Authz.main.auth] username error: %w", err)
+}
 */
@@ -0,0 +1,317 @@
+package main
+
+// login lockout module
+//
+// Password logins (POST /kauth) are protected against brute-force attacks.
+// We track login failures per user and per client IP in login_failures table,
+// which is shared by all Authz replicas. Once number of failures within
+// failure window reaches the limit, the user (or IP) is locked out and further
+// logins are rejected without contacting KDC, such that attackers can't lock
+// out real accounts at KDC level. Every subsequent failure doubles lockout
+// period (exponential backoff) up to its maximum. Successful login resets
+// user failures, and FOXDEN admins may unlock users or IPs via
+// DELETE /lockouts/:kind/:name end-point.
+//
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	server "github.com/CHESSComputing/golib/server"
+	services "github.com/CHESSComputing/golib/services"
+	"github.com/gin-gonic/gin"
+)
+
+// lockout kinds
+const (
+	lockoutUser = "user"
+	lockoutIP   = "ip"
+)
+
+// errLocked is returned when login is locked out
+var errLocked = errors.New("too many failed logins, login is temporarily locked")
+
+// LoginFailure represents login_failures table
+type LoginFailure struct {
+	ID           uint   `json:"id"`
+	KIND         string `json:"kind"` // user or ip
+	NAME         string `json:"name"`
+	FAILURES     int64  `json:"failures"`
+	LOCKED_UNTIL int64  `json:"locked_until"`
+	UPDATED      int64  `json:"updated"`
+}
+
+// LockoutPolicy represents login lockout parameters
+type LockoutPolicy struct {
+	MaxFailures   int64 // number of failures to lock out user
+	MaxIPFailures int64 // number of failures to lock out IP
+	Lockout       int64 // initial lockout period in seconds
+	MaxLockout    int64 // maximum lockout period in seconds
+	Window        int64 // period in seconds after which failures are forgotten
+}
+
+// helper function to return login lockout policy
+func lockoutPolicy() LockoutPolicy {
+	policy := LockoutPolicy{
+		MaxFailures:   _config.LoginMaxFailures,
+		MaxIPFailures: _config.LoginMaxIPFailures,
+		Lockout:       _config.LoginLockout,
+		MaxLockout:    _config.LoginMaxLockout,
+		Window:        _config.LoginFailureWindow,
+	}
+	if policy.MaxFailures <= 0 {
+		policy.MaxFailures = 5
+	}
+	if policy.MaxIPFailures <= 0 {
+		policy.MaxIPFailures = 20
+	}
+	if policy.Lockout <= 0 {
+		policy.Lockout = 60
+	}
+	if policy.MaxLockout <= 0 {
+		policy.MaxLockout = 3600
+	}
+	if policy.Window <= 0 {
+		policy.Window = 900
+	}
+	return policy
+}
+
+// helper function to return failure limit of given kind
+func (p LockoutPolicy) limit(kind string) int64 {
+	if kind == lockoutIP {
+		return p.MaxIPFailures
+	}
+	return p.MaxFailures
+}
+
+// helper function to compute lockout period for given number of failures,
+// the period is doubled on every failure after the limit
+func (p LockoutPolicy) period(kind string, failures int64) int64 {
+	excess := failures - p.limit(kind)
+	if excess < 0 {
+		return 0
+	}
+	period := p.Lockout
+	for i := int64(0); i < excess && period < p.MaxLockout; i++ {
+		period *= 2
+	}
+	if period > p.MaxLockout {
+		period = p.MaxLockout
+	}
+	return period
+}
+
+// helper function to get login failure record
+func getLoginFailure(db *sql.DB, kind, name string) (LoginFailure, error) {
+	var rec LoginFailure
+	query := "SELECT id, kind, name, failures, locked_until, updated FROM login_failures WHERE kind = ? AND name = ?"
+	err := db.QueryRow(query, kind, name).Scan(&rec.ID, &rec.KIND, &rec.NAME, &rec.FAILURES, &rec.LOCKED_UNTIL, &rec.UPDATED)
+	if err != nil {
+		return rec, fmt.Errorf("[Authz.main.getLoginFailure] row.Scan error: %w", err)
+	}
+	return rec, nil
+}
+
+// helper function to return lockout time of user or IP, 0 if they are not locked
+func lockedUntil(db *sql.DB, user, ip string) (int64, error) {
+	var until int64
+	now := time.Now().Unix()
+	for _, key := range [][2]string{{lockoutUser, user}, {lockoutIP, ip}} {
+		if key[1] == "" {
+			continue
+		}
+		rec, err := getLoginFailure(db, key[0], key[1])
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if rec.LOCKED_UNTIL > now && rec.LOCKED_UNTIL > until {
+			until = rec.LOCKED_UNTIL
+		}
+	}
+	return until, nil
+}
+
+// helper function to record login failure of given kind and name
+func addLoginFailure(db *sql.DB, kind, name string) error {
+	var err error
+	// retry if concurrent replica inserted the record first
+	for i := 0; i < 3; i++ {
+		if err = updateLoginFailure(db, kind, name); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// helper function to update login failure record within transaction
+func updateLoginFailure(db *sql.DB, kind, name string) error {
+	policy := lockoutPolicy()
+	now := time.Now().Unix()
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("[Authz.main.addLoginFailure] db.Begin error: %w", err)
+	}
+	defer tx.Rollback()
+	var id, failures, until, updated int64
+	query := "SELECT id, failures, locked_until, updated FROM login_failures WHERE kind = ? AND name = ?"
+	err = tx.QueryRow(query, kind, name).Scan(&id, &failures, &until, &updated)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("[Authz.main.addLoginFailure] row.Scan error: %w", err)
+	}
+	// forget old failures unless user is (or was recently) locked out
+	if err == nil && until < now && updated+policy.Window < now {
+		failures = 0
+	}
+	failures++
+	if period := policy.period(kind, failures); period > 0 {
+		until = now + period
+		log.Printf("WARNING: %s %s is locked out for %d seconds after %d failed logins", kind, name, period, failures)
+	}
+	if err == sql.ErrNoRows {
+		query = "INSERT INTO login_failures (kind, name, failures, locked_until, updated) VALUES (?, ?, ?, ?, ?)"
+		_, err = tx.Exec(query, kind, name, failures, until, now)
+	} else {
+		query = "UPDATE login_failures SET failures = ?, locked_until = ?, updated = ? WHERE id = ?"
+		_, err = tx.Exec(query, failures, until, now, id)
+	}
+	if err != nil {
+		return fmt.Errorf("[Authz.main.addLoginFailure] tx.Exec error: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("[Authz.main.addLoginFailure] tx.Commit error: %w", err)
+	}
+	return nil
+}
+
+// helper function to remove login failures of given kind and name, it
+// returns sql.ErrNoRows if there are no failures
+func deleteLoginFailures(db *sql.DB, kind, name string) error {
+	res, err := db.Exec("DELETE FROM login_failures WHERE kind = ? AND name = ?", kind, name)
+	if err != nil {
+		return fmt.Errorf("[Authz.main.deleteLoginFailures] db.Exec error: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// helper function to list login failures
+func listLoginFailures(db *sql.DB) ([]LoginFailure, error) {
+	records := []LoginFailure{}
+	query := "SELECT id, kind, name, failures, locked_until, updated FROM login_failures ORDER BY updated DESC"
+	rows, err := db.Query(query)
+	if err != nil {
+		return records, fmt.Errorf("[Authz.main.listLoginFailures] db.Query error: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rec LoginFailure
+		err := rows.Scan(&rec.ID, &rec.KIND, &rec.NAME, &rec.FAILURES, &rec.LOCKED_UNTIL, &rec.UPDATED)
+		if err != nil {
+			return records, fmt.Errorf("[Authz.main.listLoginFailures] rows.Scan error: %w", err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// helper function to check login lockout of user and IP, it writes error
+// page and returns false if login is locked out
+func checkLockout(c *gin.Context, user, ip string) bool {
+	until, err := lockedUntil(_DB, user, ip)
+	if err != nil {
+		// do not block logins if lockout state is not available
+		log.Println("ERROR:", err)
+		return true
+	}
+	if until == 0 {
+		return true
+	}
+	auditDenied(c.Request, auditLogin, user, "", "", "kerberos", errLocked)
+	c.Set("failed", "Locked")
+	retry := until - time.Now().Unix()
+	if retry < 1 {
+		retry = 1
+	}
+	c.Header("Retry-After", strconv.FormatInt(retry, 10))
+	tmpl := server.MakeTmpl(StaticFs, "Error")
+	tmpl["Message"] = fmt.Sprintf("TOO MANY FAILED LOGINS, PLEASE TRY AGAIN IN %d SECONDS", retry)
+	page := server.TmplPage(StaticFs, "error.tmpl", tmpl)
+	c.Writer.WriteHeader(http.StatusTooManyRequests)
+	c.Writer.Write([]byte(page))
+	return false
+}
+
+// helper function to record outcome of login of user from given IP
+func loginOutcome(user, ip string, success bool) {
+	if success {
+		// successful login resets user failures, while IP failures expire with time
+		if err := deleteLoginFailures(_DB, lockoutUser, user); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Println("ERROR:", err)
+		}
+		return
+	}
+	for _, key := range [][2]string{{lockoutUser, user}, {lockoutIP, ip}} {
+		if key[1] == "" {
+			continue
+		}
+		if err := addLoginFailure(_DB, key[0], key[1]); err != nil {
+			log.Println("ERROR:", err)
+		}
+	}
+}
+
+// LockoutsHandler provides access to GET /lockouts end-point
+func LockoutsHandler(c *gin.Context) {
+	if !adminRequest(c) {
+		return
+	}
+	records, err := listLoginFailures(_DB)
+	if err != nil {
+		rec := services.Response("Authz", http.StatusInternalServerError, services.DatabaseError, err)
+		c.JSON(http.StatusInternalServerError, rec)
+		return
+	}
+	c.JSON(http.StatusOK, records)
+}
+
+// UnlockHandler provides access to DELETE /lockouts/:kind/:name end-point
+func UnlockHandler(c *gin.Context) {
+	if !adminRequest(c) {
+		return
+	}
+	kind, name := c.Param("kind"), c.Param("name")
+	if kind != lockoutUser && kind != lockoutIP {
+		err := fmt.Errorf("invalid lockout kind %s, should be %s or %s", kind, lockoutUser, lockoutIP)
+		rec := services.Response("Authz", http.StatusBadRequest, services.ParametersError, err)
+		c.JSON(http.StatusBadRequest, rec)
+		return
+	}
+	if err := deleteLoginFailures(_DB, kind, name); err != nil {
+		rec := services.Response("Authz", http.StatusNotFound, services.DatabaseError, err)
+		c.JSON(http.StatusNotFound, rec)
+		return
+	}
+	claims := requestClaims(c)
+	log.Printf("INFO: %s %s is unlocked by %s", kind, name, claims.CustomClaims.User)
+	c.JSON(http.StatusOK, gin.H{"kind": kind, "name": name, "unlocked": true})
+}
+
+// helper function to remove stale login failures
+func cleanupLoginFailures(db *sql.DB) error {
+	now := time.Now().Unix()
+	query := "DELETE FROM login_failures WHERE locked_until < ? AND updated < ?"
+	if _, err := db.Exec(query, now, now-lockoutPolicy().Window); err != nil {
+		return fmt.Errorf("[Authz.main.cleanupLoginFailures] db.Exec error: %w", err)
+	}
+	return nil
+}
@@ -19,6 +19,8 @@ import (
 func main() {
 	var version bool
 	flag.BoolVar(&version, "version", false, "Show version")
+	var verify bool
+	flag.BoolVar(&verify, "verify-audit", false, "verify hash chain of audit log and exit")
 	cfile := os.Getenv("FOXDEN_CONFIG")
 	var config string
 	flag.StringVar(&config, "config", cfile, "server config file, default $FOXDEN_CONFIG")
@@ -32,8 +34,18 @@ func main() {
 	} else {
 		log.Fatal(fmt.Sprintf("Unable to parse config='%s'\nerror: %v", config, err))
 	}
+	if err := parseConfig(); err != nil {
+		log.Fatal(err)
+	}
 	if srvConfig.Config.Authz.WebServer.Verbose > 0 {
 		log.SetFlags(log.Llongfile)
 	}
+	if verify {
+		initDB()
+		if err := verifyAuditLog(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	Server()
 }
@@ -0,0 +1,296 @@
+package main
+
+// metrics module
+//
+// Authz exposes Prometheus metrics of authentication outcomes via
+// /metrics/authz end-point, while generic server metrics are provided by
+// /metrics end-point of golib router. Handlers record outcome of the request
+// via failed context key where they decide it, see instrumented.
+// We provide the following metrics:
+// - <prefix>_requests_total{handler,outcome,code} counter of handler requests
+// - <prefix>_request_duration_seconds{handler} histogram of handler latency
+// - <prefix>_kdc_duration_seconds{outcome} histogram of Kerberos KDC logins
+// - <prefix>_user_attributes_duration_seconds{outcome} histogram of foxden user lookups
+// - <prefix>_tokens_issued_total{kind} counter of issued access tokens
+// - <prefix>_active_access_tokens{kind} gauge of unexpired access tokens
+// - <prefix>_active_refresh_tokens{kind} gauge of usable refresh tokens
+//
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	srvConfig "github.com/CHESSComputing/golib/config"
+	services "github.com/CHESSComputing/golib/services"
+	"github.com/gin-gonic/gin"
+)
+
+// metricsBuckets defines upper bounds (in seconds) of latency histograms
+var metricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// serviceCodes provides names of golib service codes used as metric labels
+var serviceCodes = map[int]string{
+	services.DatabaseError:    "DatabaseError",
+	services.ParseError:       "ParseError",
+	services.ParametersError:  "ParametersError",
+	services.ReaderError:      "ReaderError",
+	services.UnmarshalError:   "UnmarshalError",
+	services.MarshalError:     "MarshalError",
+	services.CredentialsError: "CredentialsError",
+	services.TokenError:       "TokenError",
+	services.ScopeError:       "ScopeError",
+	services.NotFoundError:    "NotFoundError",
+	services.AuthError:        "AuthError",
+	services.LDAPSearchError:  "LDAPSearchError",
+	services.LDAPGroupError:   "LDAPGroupError",
+}
+
+// histogram represents Prometheus histogram
+type histogram struct {
+	Counts []uint64 // counts per bucket of metricsBuckets, the last one is +Inf
+	Sum    float64
+	Count  uint64
+}
+
+// helper function to add observation to histogram
+func (h *histogram) observe(value float64) {
+	if h.Counts == nil {
+		h.Counts = make([]uint64, len(metricsBuckets)+1)
+	}
+	idx := sort.SearchFloat64s(metricsBuckets, value)
+	h.Counts[idx]++
+	h.Sum += value
+	h.Count++
+}
+
+// AuthzMetrics keeps Authz metrics
+type AuthzMetrics struct {
+	mutex        sync.Mutex
+	Requests     map[[3]string]uint64        // handler, outcome, code
+	Latency      map[string]*histogram       // histograms of handler latency
+	KDC          map[string]*histogram       // histograms of KDC latency by outcome
+	Attributes   map[string]*histogram       // histograms of foxden user lookups by outcome
+	Issued       map[string]uint64           // issued access tokens by kind
+	AccessTokens map[string]map[string]int64 // expiration of issued access tokens by kind and jti
+}
+
+// _metrics holds Authz metrics
+var _metrics = &AuthzMetrics{
+	Requests:     make(map[[3]string]uint64),
+	Latency:      make(map[string]*histogram),
+	KDC:          make(map[string]*histogram),
+	Attributes:   make(map[string]*histogram),
+	Issued:       make(map[string]uint64),
+	AccessTokens: make(map[string]map[string]int64),
+}
+
+// helper function to observe latency in given histograms
+func (m *AuthzMetrics) observe(hmap map[string]*histogram, key string, elapsed time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	h, ok := hmap[key]
+	if !ok {
+		h = &histogram{}
+		hmap[key] = h
+	}
+	h.observe(elapsed.Seconds())
+}
+
+// helper function to count handler request
+func (m *AuthzMetrics) request(handler, outcome, code string, elapsed time.Duration) {
+	m.observe(m.Latency, handler, elapsed)
+	m.mutex.Lock()
+	m.Requests[[3]string{handler, outcome, code}]++
+	m.mutex.Unlock()
+}
+
+// helper function to count issued access token
+func (m *AuthzMetrics) issued(kind, jti string, expires int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Issued[kind]++
+	if jti == "" || expires <= 0 {
+		return
+	}
+	now := time.Now().Unix()
+	tokens, ok := m.AccessTokens[kind]
+	if !ok {
+		tokens = make(map[string]int64)
+		m.AccessTokens[kind] = tokens
+	}
+	tokens[jti] = now + expires
+	// remove expired tokens to keep the map bounded
+	for id, exp := range tokens {
+		if exp < now {
+			delete(tokens, id)
+		}
+	}
+}
+
+// helper function to observe outcome of a call with given histograms
+func observeCall(hmap map[string]*histogram, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	_metrics.observe(hmap, outcome, time.Since(start))
+}
+
+// helper function to provide name of golib service code used as metric label
+func serviceCodeName(code int) string {
+	if name, ok := serviceCodes[code]; ok {
+		return name
+	}
+	return strconv.Itoa(code)
+}
+
+// instrumented wraps gin handler to collect its metrics, the outcome of the
+// request is failure if handler marks request as failed via failed context
+// key, e.g. errorResponse or oauthError, or returns HTTP error
+func instrumented(name string, handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		handler(c)
+		outcome, code := "success", ""
+		if val, ok := c.Get("failed"); ok {
+			outcome, code = "failure", fmt.Sprintf("%v", val)
+		} else if status := c.Writer.Status(); status >= http.StatusBadRequest {
+			outcome, code = "failure", strconv.Itoa(status)
+		}
+		_metrics.request(name, outcome, code, time.Since(start))
+	}
+}
+
+// timedUserAttributes wraps foxden user attributes to measure latency of user lookups
+type timedUserAttributes struct {
+	services.UserAttributes
+}
+
+// Get returns foxden user and records latency of the lookup
+func (u *timedUserAttributes) Get(user string) (services.User, error) {
+	start := time.Now()
+	fuser, err := u.UserAttributes.Get(user)
+	observeCall(_metrics.Attributes, start, err)
+	return fuser, err
+}
+
+// helper function to count active refresh tokens by kind
+func activeRefreshTokens() (map[string]int64, error) {
+	out := make(map[string]int64)
+	query := "SELECT kind, COUNT(*) FROM refresh_tokens WHERE used = 0 AND revoked = 0 AND expires > ? GROUP BY kind"
+	rows, err := _DB.Query(query, time.Now().Unix())
+	if err != nil {
+		return out, fmt.Errorf("[Authz.main.activeRefreshTokens] db.Query error: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind string
+		var count int64
+		if err := rows.Scan(&kind, &count); err != nil {
+			return out, fmt.Errorf("[Authz.main.activeRefreshTokens] rows.Scan error: %w", err)
+		}
+		out[kind] = count
+	}
+	return out, nil
+}
+
+// helper function to write histograms in prometheus format
+func promHistograms(out *strings.Builder, name, label, help string, hmap map[string]*histogram) {
+	fmt.Fprintf(out, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(out, "# TYPE %s histogram\n", name)
+	for _, key := range sortedKeys(hmap) {
+		h := hmap[key]
+		var cumulative uint64
+		for i, bound := range metricsBuckets {
+			cumulative += h.Counts[i]
+			fmt.Fprintf(out, "%s_bucket{%s=%q,le=\"%v\"} %d\n", name, label, key, bound, cumulative)
+		}
+		fmt.Fprintf(out, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, label, key, h.Count)
+		fmt.Fprintf(out, "%s_sum{%s=%q} %v\n", name, label, key, h.Sum)
+		fmt.Fprintf(out, "%s_count{%s=%q} %d\n", name, label, key, h.Count)
+	}
+}
+
+// helper function to write gauge or counter by kind in prometheus format
+func promKinds(out *strings.Builder, name, mtype, help string, values map[string]int64) {
+	fmt.Fprintf(out, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(out, "# TYPE %s %s\n", name, mtype)
+	for _, kind := range sortedKeys(values) {
+		fmt.Fprintf(out, "%s{kind=%q} %d\n", name, kind, values[kind])
+	}
+}
+
+// helper function to return sorted keys of the map
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// helper function to generate Authz metrics in prometheus format
+func promAuthzMetrics(prefix string) string {
+	refresh, err := activeRefreshTokens()
+	if err != nil {
+		log.Println("ERROR:", err)
+	}
+	m := _metrics
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var out strings.Builder
+
+	name := prefix + "_requests_total"
+	fmt.Fprintf(&out, "# HELP %s number of requests by handler, outcome and error code\n", name)
+	fmt.Fprintf(&out, "# TYPE %s counter\n", name)
+	keys := make([][3]string, 0, len(m.Requests))
+	for key := range m.Requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return strings.Join(keys[i][:], " ") < strings.Join(keys[j][:], " ")
+	})
+	for _, key := range keys {
+		fmt.Fprintf(&out, "%s{handler=%q,outcome=%q,code=%q} %d\n", name, key[0], key[1], key[2], m.Requests[key])
+	}
+
+	promHistograms(&out, prefix+"_request_duration_seconds", "handler",
+		"latency of handler requests", m.Latency)
+	promHistograms(&out, prefix+"_kdc_duration_seconds", "outcome",
+		"latency of Kerberos KDC logins", m.KDC)
+	promHistograms(&out, prefix+"_user_attributes_duration_seconds", "outcome",
+		"latency of foxden user attributes lookups", m.Attributes)
+
+	issued := make(map[string]int64)
+	for kind, count := range m.Issued {
+		issued[kind] = int64(count)
+	}
+	promKinds(&out, prefix+"_tokens_issued_total", "counter", "number of issued access tokens", issued)
+	now := time.Now().Unix()
+	active := make(map[string]int64)
+	for kind, tokens := range m.AccessTokens {
+		for _, exp := range tokens {
+			if exp >= now {
+				active[kind]++
+			}
+		}
+	}
+	promKinds(&out, prefix+"_active_access_tokens", "gauge", "number of unexpired access tokens issued by this server", active)
+	promKinds(&out, prefix+"_active_refresh_tokens", "gauge", "number of usable refresh tokens", refresh)
+	return out.String()
+}
+
+// AuthzMetricsHandler provides Authz metrics in prometheus format
+func AuthzMetricsHandler(c *gin.Context) {
+	prefix := srvConfig.Config.Authz.WebServer.MetricsPrefix
+	if prefix == "" {
+		prefix = "authz"
+	}
+	c.Data(http.StatusOK, "text/plain; version=0.0.4", []byte(promAuthzMetrics(prefix)))
+}
@@ -0,0 +1,31 @@
+package main
+
+// metrics tests
+//
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestMetricsOutcome tests that outcome and code of instrumented handler
+// are exposed by /metrics/authz end-point
+func TestMetricsOutcome(t *testing.T) {
+	setupKerberosTest(t)
+	rec := KerberosRequest{}
+	rec.User, rec.Scope = testUser, "read"
+	if w := postJSON(t, "/oauth/authorize", rec); w.Code != http.StatusBadRequest {
+		t.Fatalf("missing AP-REQ: unexpected status %d", w.Code)
+	}
+	w := serve(httptest.NewRequest("GET", "/metrics/authz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	metric := fmt.Sprintf("authz_requests_total{handler=%q,outcome=%q,code=%q}",
+		"ClientAuthHandler", "failure", "CredentialsError")
+	if !strings.Contains(w.Body.String(), metric) {
+		t.Errorf("metric %s is not found in:\n%s", metric, w.Body.String())
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+// SPNEGO (HTTP Negotiate) module
+//
+// When Kerberos keytab of Authz service (Kerberos.Keytab) is configured,
+// users with valid Kerberos ticket may obtain token without password via
+// GET /oauth/negotiate end-point, e.g.
+//
+// kinit user@CLASSE.CORNELL.EDU
+// curl --negotiate -u : "https://foxden.classe.cornell.edu/authz/oauth/negotiate?scope=read"
+//
+// The negotiated middleware validates SPNEGO token of the request against
+// the keytab and stores authenticated user in gin context, such that it can
+// protect any gin route.
+//
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+
+	srvConfig "github.com/CHESSComputing/golib/config"
+	services "github.com/CHESSComputing/golib/services"
+	"github.com/gin-gonic/gin"
+	goidentity "gopkg.in/jcmturner/goidentity.v3"
+	"gopkg.in/jcmturner/gokrb5.v7/keytab"
+	"gopkg.in/jcmturner/gokrb5.v7/service"
+	"gopkg.in/jcmturner/gokrb5.v7/spnego"
+)
+
+// _keytab holds keytab of Authz service used to validate SPNEGO tokens
+var _keytab *keytab.Keytab
+
+// helper function to load keytab of Authz service if it is configured
+func initKeytab() error {
+	if srvConfig.Config.Kerberos.Keytab == "" {
+		return nil
+	}
+	kt, err := keytab.Load(srvConfig.Config.Kerberos.Keytab)
+	if err != nil {
+		return err
+	}
+	_keytab = kt
+	return nil
+}
+
+// negotiateMiddleware provides gin middleware which authenticates request
+// via SPNEGO, the FOXDEN user mapped from Kerberos principal and its realm are
+// stored in gin context under "kerberos_user" and "kerberos_realm" keys.
+// Requests without Negotiate authorization header get 401 with
+// WWW-Authenticate: Negotiate, and users of not allowed realms get 403.
+func negotiateMiddleware() gin.HandlerFunc {
+	l := log.New(os.Stderr, "GOKRB5 Service: ", log.Ldate|log.Ltime|log.Lshortfile)
+	return func(c *gin.Context) {
+		if _keytab == nil {
+			err := errors.New("SPNEGO authentication is not configured")
+			errorResponse(c, http.StatusNotImplemented, services.AuthError, err)
+			return
+		}
+		authenticated := false
+		var realmErr error
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if id, ok := r.Context().Value(spnego.CTXKeyCredentials).(goidentity.Identity); ok {
+				realm, err := findRealm(id.Domain())
+				if err != nil {
+					realmErr = err
+					return
+				}
+				authenticated = true
+				c.Request = r
+				c.Set("kerberos_user", realm.username(id.UserName()))
+				c.Set("kerberos_realm", realm.Realm)
+			}
+		})
+		spnego.SPNEGOKRB5Authenticate(inner, _keytab, service.Logger(l), service.MaxClockSkew(clockSkew())).ServeHTTP(c.Writer, c.Request)
+		if realmErr != nil {
+			auditDenied(c.Request, auditLogin, "", "", "", "negotiate", realmErr)
+			errorResponse(c, http.StatusForbidden, services.AuthError, realmErr)
+			return
+		}
+		if !authenticated {
+			if c.Writer.Status() == http.StatusOK {
+				c.Writer.WriteHeader(http.StatusUnauthorized)
+			}
+			// initial request without Negotiate header is a challenge, not a failure
+			if c.Request.Header.Get("Authorization") != "" {
+				auditDenied(c.Request, auditLogin, "", "", "", "negotiate", errors.New("SPNEGO authentication failed"))
+			}
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// helper function to define handler which requires SPNEGO authentication
+func negotiated(handler gin.HandlerFunc) gin.HandlerFunc {
+	middleware := negotiateMiddleware()
+	return func(c *gin.Context) {
+		middleware(c)
+		if c.IsAborted() {
+			return
+		}
+		handler(c)
+	}
+}
+
+// NegotiateHandler provides access to GET /oauth/negotiate end-point, it
+// issues token for user authenticated via SPNEGO
+func NegotiateHandler(c *gin.Context) {
+	r := c.Request
+	user, realm := c.GetString("kerberos_user"), c.GetString("kerberos_realm")
+	audit(r, AuditRecord{EVENT: auditLogin, OUTCOME: "allow", LOGIN: user, KIND: "negotiate"})
+	if !allowUser(c, user) {
+		return
+	}
+	scope := r.URL.Query().Get("scope")
+	if scope == "" {
+		scope = "read"
+	}
+	kerberosToken(c, user, realm, scope, 0)
+}
@@ -0,0 +1,518 @@
+package main
+
+// OAuth2 authorization code flow module
+//
+// We use go-oauth2 server to implement authorization code flow with PKCE
+// (RFC 6749 section 4.1 and RFC 7636). The users are authenticated via
+// Kerberos login page (see LoginHandler and KAuthHandler) which sets
+// auth-session cookie, and access tokens are generated by tokenMap.
+//
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	authz "github.com/CHESSComputing/golib/authz"
+	srvConfig "github.com/CHESSComputing/golib/config"
+	utils "github.com/CHESSComputing/golib/utils"
+	"github.com/gin-gonic/gin"
+	oauth2 "github.com/go-oauth2/oauth2/v4"
+	oauth2Errors "github.com/go-oauth2/oauth2/v4/errors"
+	"github.com/go-oauth2/oauth2/v4/manage"
+	"github.com/go-oauth2/oauth2/v4/models"
+	oauth2Server "github.com/go-oauth2/oauth2/v4/server"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// _oauthServer holds go-oauth2 server instance
+var _oauthServer *oauth2Server.Server
+
+// Client represents OAuth client, it implements oauth2.ClientInfo interface
+type Client struct {
+	ID           string
+	Secret       string
+	Hashed       bool // secret is stored as bcrypt hash
+	RedirectURIs []string
+	GrantTypes   []string  // allowed grant types, empty list allows all grant types
+	Scopes       []string  // allowed scopes, empty list allows all scopes
+	Audiences    []string  // allowed audiences, empty list allows all audiences
+	RateLimit    RateLimit // client quota of token requests
+	Public       bool
+	Owner        string
+}
+
+// GetID returns client ID
+func (c *Client) GetID() string {
+	return c.ID
+}
+
+// GetSecret returns client secret
+func (c *Client) GetSecret() string {
+	return c.Secret
+}
+
+// GetDomain returns client domain, i.e. its first registered redirect URI
+func (c *Client) GetDomain() string {
+	if len(c.RedirectURIs) > 0 {
+		return c.RedirectURIs[0]
+	}
+	return ""
+}
+
+// IsPublic returns if client is public one, i.e. it does not have a secret
+func (c *Client) IsPublic() bool {
+	return c.Public
+}
+
+// GetUserID returns client owner
+func (c *Client) GetUserID() string {
+	return c.Owner
+}
+
+// VerifyPassword implements oauth2.ClientPasswordVerifier interface
+func (c *Client) VerifyPassword(secret string) bool {
+	if c.Public {
+		return true
+	}
+	if c.Hashed {
+		return bcrypt.CompareHashAndPassword([]byte(c.Secret), []byte(secret)) == nil
+	}
+	return equalSecrets(secret, c.Secret)
+}
+
+// AllowedGrant checks if client is allowed to use given grant type
+func (c *Client) AllowedGrant(grantType string) bool {
+	return len(c.GrantTypes) == 0 || utils.InList(grantType, c.GrantTypes)
+}
+
+// AllowedScope checks if client is allowed to request given scope
+func (c *Client) AllowedScope(scope string) bool {
+	if len(c.Scopes) == 0 {
+		return true
+	}
+	for _, s := range scopes(scope) {
+		if !utils.InList(s, c.Scopes) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidRedirectURI checks if given redirect URI is registered for the client
+func (c *Client) ValidRedirectURI(uri string) bool {
+	for _, u := range c.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientStore represents store of OAuth clients registered in Authz database or
+// defined in Authz configuration, it implements oauth2.ClientStore interface
+type ClientStore struct{}
+
+// GetByID returns client info for given client ID
+func (s *ClientStore) GetByID(ctx context.Context, id string) (oauth2.ClientInfo, error) {
+	return getClient(id)
+}
+
+// helper function to find OAuth client with given client ID
+func getClient(clientId string) (*Client, error) {
+	if clientId == "" {
+		return nil, errors.New("empty client ID")
+	}
+	if clientId == srvConfig.Config.Authz.ClientID {
+		client := &Client{
+			ID:     srvConfig.Config.Authz.ClientID,
+			Secret: srvConfig.Config.Authz.ClientSecret,
+		}
+		return client, nil
+	}
+	if rec, err := getClientRecord(_DB, clientId); err == nil {
+		return rec.Client(), nil
+	}
+	for _, c := range _config.Clients {
+		if c.ClientID == clientId {
+			client := &Client{
+				ID:           c.ClientID,
+				Secret:       c.ClientSecret,
+				RedirectURIs: c.RedirectURIs,
+				Audiences:    c.Audiences,
+				RateLimit:    c.RateLimit,
+				Public:       c.ClientSecret == "",
+			}
+			return client, nil
+		}
+	}
+	return nil, fmt.Errorf("client %s is not found", clientId)
+}
+
+// CodeStore represents store of authorization codes in Authz database,
+// it implements oauth2.TokenStore interface. We only keep authorization
+// codes since access tokens are self-contained JWT tokens.
+type CodeStore struct {
+	DB *sql.DB
+}
+
+// Create stores authorization code information
+func (s *CodeStore) Create(ctx context.Context, info oauth2.TokenInfo) error {
+	code := info.GetCode()
+	if code == "" {
+		return nil
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("[Authz.main.CodeStore.Create] json.Marshal error: %w", err)
+	}
+	expires := info.GetCodeCreateAt().Add(info.GetCodeExpiresIn()).Unix()
+	query := "INSERT INTO oauth_codes (code, data, expires, created) VALUES (?, ?, ?, ?)"
+	if _, err := s.DB.Exec(query, hashToken(code), string(data), expires, time.Now().Unix()); err != nil {
+		return fmt.Errorf("[Authz.main.CodeStore.Create] db.Exec error: %w", err)
+	}
+	return nil
+}
+
+// RemoveByCode removes authorization code, since codes are single use only
+// we report an error if code was already removed
+func (s *CodeStore) RemoveByCode(ctx context.Context, code string) error {
+	query := "DELETE FROM oauth_codes WHERE code = ?"
+	result, err := s.DB.Exec(query, hashToken(code))
+	if err != nil {
+		return fmt.Errorf("[Authz.main.CodeStore.RemoveByCode] db.Exec error: %w", err)
+	}
+	if nrows, err := result.RowsAffected(); err == nil && nrows == 0 {
+		return oauth2Errors.ErrInvalidAuthorizeCode
+	}
+	return nil
+}
+
+// RemoveByAccess is no-op since we do not store access tokens
+func (s *CodeStore) RemoveByAccess(ctx context.Context, access string) error {
+	return nil
+}
+
+// RemoveByRefresh is no-op since we do not store refresh tokens
+func (s *CodeStore) RemoveByRefresh(ctx context.Context, refresh string) error {
+	return nil
+}
+
+// GetByCode returns authorization code information
+func (s *CodeStore) GetByCode(ctx context.Context, code string) (oauth2.TokenInfo, error) {
+	var data string
+	var expires int64
+	query := "SELECT data, expires FROM oauth_codes WHERE code = ?"
+	err := s.DB.QueryRow(query, hashToken(code)).Scan(&data, &expires)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("[Authz.main.CodeStore.GetByCode] row.Scan error: %w", err)
+	}
+	if expires < time.Now().Unix() {
+		return nil, nil
+	}
+	info := models.NewToken()
+	if err := json.Unmarshal([]byte(data), info); err != nil {
+		return nil, fmt.Errorf("[Authz.main.CodeStore.GetByCode] json.Unmarshal error: %w", err)
+	}
+	return info, nil
+}
+
+// GetByAccess is not supported since we do not store access tokens
+func (s *CodeStore) GetByAccess(ctx context.Context, access string) (oauth2.TokenInfo, error) {
+	return nil, nil
+}
+
+// GetByRefresh is not supported since we do not store refresh tokens
+func (s *CodeStore) GetByRefresh(ctx context.Context, refresh string) (oauth2.TokenInfo, error) {
+	return nil, nil
+}
+
+// helper function to cleanup expired authorization codes
+func cleanupCodes(db *sql.DB) error {
+	query := "DELETE FROM oauth_codes WHERE expires < ?"
+	if _, err := db.Exec(query, time.Now().Unix()); err != nil {
+		return fmt.Errorf("[Authz.main.cleanupCodes] db.Exec error: %w", err)
+	}
+	return nil
+}
+
+// AccessGenerate generates Authz access tokens, it implements oauth2.AccessGenerate interface
+type AccessGenerate struct{}
+
+// Token generates access token for given user and scope of token info, the
+// token request may narrow down audience of authorization request
+func (a *AccessGenerate) Token(ctx context.Context, data *oauth2.GenerateBasic, isGenRefresh bool) (string, string, error) {
+	ti := data.TokenInfo
+	client, ok := data.Client.(*Client)
+	if !ok {
+		return "", "", oauth2Errors.ErrInvalidClient
+	}
+	granted := client.Audiences
+	if eti, ok := ti.(oauth2.ExtendableTokenInfo); ok && eti.GetExtension() != nil {
+		if aud := strings.Fields(eti.GetExtension().Get("audience")); len(aud) > 0 {
+			granted = aud
+		}
+	}
+	var requested []string
+	if data.Request != nil {
+		requested = requestAudience(data.Request)
+	}
+	audience, err := narrowAudience(requested, granted)
+	if err == nil {
+		audience, err = clientAudience(client, audience)
+	}
+	if err != nil {
+		return "", "", oauth2Errors.ErrInvalidRequest
+	}
+	expires := int64(ti.GetAccessExpiresIn() / time.Second)
+	tmap, err := tokenMap(data.UserID, ti.GetScope(), "authorization_code", "Authz", expires, audience...)
+	if err != nil {
+		return "", "", err
+	}
+	auditIssued(data.Request, tmap, data.UserID, client.ID, ti.GetScope(), "authorization_code")
+	return tmap.AccessToken, "", nil
+}
+
+// helper function to issue rotating refresh token and id token along with
+// access token of authorization code flow
+func oauthExtensionFields(ti oauth2.TokenInfo) map[string]interface{} {
+	out := make(map[string]interface{})
+	claims, err := parseToken(ti.GetAccess())
+	if err != nil {
+		log.Println("ERROR: unable to parse issued access token", err)
+		return out
+	}
+	tmap := TokenMap{TokenID: claims.ID, Audience: claims.Audience}
+	tmap.Expires = int64(ti.GetAccessExpiresIn() / time.Second)
+	err = addRefreshToken(&tmap, "", ti.GetUserID(), ti.GetClientID(), ti.GetScope(), "authorization_code")
+	if err != nil {
+		log.Println("ERROR: unable to issue refresh token", err)
+		return out
+	}
+	out["refresh_token"] = tmap.RefreshToken
+	// issue id token if client requested openid scope
+	if utils.InList("openid", scopes(ti.GetScope())) {
+		var nonce string
+		if eti, ok := ti.(oauth2.ExtendableTokenInfo); ok && eti.GetExtension() != nil {
+			nonce = eti.GetExtension().Get("nonce")
+		}
+		token, err := idToken(ti.GetUserID(), ti.GetClientID(), nonce, tmap.Expires)
+		if err != nil {
+			log.Println("ERROR: unable to issue id token", err)
+			return out
+		}
+		out["id_token"] = token
+	}
+	return out
+}
+
+// helper function to initialize go-oauth2 server
+func initOAuthServer() {
+	manager := manage.NewDefaultManager()
+	manager.MapTokenStorage(&CodeStore{DB: _DB})
+	manager.MapClientStorage(&ClientStore{})
+	manager.MapAccessGenerate(&AccessGenerate{})
+	expires := time.Duration(srvConfig.Config.Authz.TokenExpires) * time.Second
+	if expires == 0 {
+		expires = 7200 * time.Second
+	}
+	manager.SetAuthorizeCodeTokenCfg(&manage.Config{AccessTokenExp: expires})
+	// keep OpenID nonce and audience of authorization request within
+	// authorization code, the code extension is carried over to token info
+	// of code exchange where audience of authorization request is preserved
+	manager.SetExtractExtensionHandler(func(tgr *oauth2.TokenGenerateRequest, ti oauth2.ExtendableTokenInfo) {
+		if tgr.Request == nil {
+			return
+		}
+		ext := ti.GetExtension()
+		if ext == nil {
+			ext = url.Values{}
+		}
+		if nonce := tgr.Request.FormValue("nonce"); nonce != "" {
+			ext.Set("nonce", nonce)
+		}
+		if aud := requestAudience(tgr.Request); len(aud) > 0 && ext.Get("audience") == "" {
+			ext.Set("audience", strings.Join(aud, " "))
+		}
+		if len(ext) > 0 {
+			ti.SetExtension(ext)
+		}
+	})
+	// redirect URIs are validated against registered client redirect URIs by
+	// AuthorizeHandler, while code exchange requires the same redirect URI as
+	// was used in authorization request (it is checked by go-oauth2 manager)
+	manager.SetValidateURIHandler(func(baseURI, redirectURI string) error {
+		return nil
+	})
+
+	config := &oauth2Server.Config{
+		TokenType:                   "bearer",
+		AllowedResponseTypes:        []oauth2.ResponseType{oauth2.Code},
+		AllowedGrantTypes:           []oauth2.GrantType{oauth2.AuthorizationCode},
+		AllowedCodeChallengeMethods: []oauth2.CodeChallengeMethod{oauth2.CodeChallengeS256},
+		ForcePKCE:                   true,
+	}
+	srv := oauth2Server.NewServer(config, manager)
+	srv.SetClientInfoHandler(func(r *http.Request) (string, string, error) {
+		clientId, clientSecret := clientCredentials(r)
+		if clientId == "" {
+			return "", "", oauth2Errors.ErrInvalidClient
+		}
+		return clientId, clientSecret, nil
+	})
+	srv.SetClientAuthorizedHandler(func(clientId string, grant oauth2.GrantType) (bool, error) {
+		client, err := getClient(clientId)
+		if err != nil {
+			return false, err
+		}
+		return client.AllowedGrant(grant.String()), nil
+	})
+	srv.SetClientScopeHandler(func(tgr *oauth2.TokenGenerateRequest) (bool, error) {
+		client, err := getClient(tgr.ClientID)
+		if err != nil {
+			return false, err
+		}
+		return client.AllowedScope(tgr.Scope), nil
+	})
+	srv.SetUserAuthorizationHandler(userAuthorizationHandler)
+	srv.SetAuthorizeScopeHandler(func(w http.ResponseWriter, r *http.Request) (string, error) {
+		if scope := r.FormValue("scope"); scope != "" {
+			return scope, nil
+		}
+		return "read", nil
+	})
+	srv.SetExtensionFieldsHandler(oauthExtensionFields)
+	srv.SetInternalErrorHandler(func(err error) *oauth2Errors.Response {
+		log.Println("ERROR: oauth server error", err)
+		return nil
+	})
+	_oauthServer = srv
+}
+
+// helper function to authenticate user of authorization request, if user
+// does not have valid session we redirect to login page which redirects
+// back to authorization request after successful login
+func userAuthorizationHandler(w http.ResponseWriter, r *http.Request) (string, error) {
+	user, err := sessionUser(r)
+	if err != nil {
+		if Verbose > 0 {
+			log.Println("no valid session, redirect to login page:", err)
+		}
+		loginURL := fmt.Sprintf("%s/login?redirect=%s", srvConfig.Config.Authz.WebServer.Base, url.QueryEscape(r.URL.RequestURI()))
+		http.Redirect(w, r, loginURL, http.StatusFound)
+		return "", nil
+	}
+	scope := r.FormValue("scope")
+	if scope == "" {
+		scope = "read"
+	}
+	if _, err := checkUserScope(user, scope); err != nil {
+		log.Printf("ERROR: user %s is not authorized for scope %s: %v", user, scope, err)
+		auditDenied(r, auditToken, user, r.FormValue("client_id"), scope, "authorization_code", err)
+		return "", oauth2Errors.ErrAccessDenied
+	}
+	return user, nil
+}
+
+// helper function to set auth-session cookie for authenticated user, the
+// cookie holds short-lived session token which is not valid access token
+func setSessionCookie(w http.ResponseWriter, r *http.Request, user string) error {
+	expires := int64(24 * 3600)
+	auser := authz.AuthUser{Name: user, App: "Authz", Expires: expires}
+	token, err := signSessionToken(auser)
+	if err != nil {
+		return err
+	}
+	cookie := http.Cookie{
+		Name:     "auth-session",
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(time.Duration(expires) * time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &cookie)
+	return nil
+}
+
+// helper function to get user of auth-session cookie
+func sessionUser(r *http.Request) (string, error) {
+	cookie, err := r.Cookie("auth-session")
+	if err != nil {
+		return "", fmt.Errorf("[Authz.main.sessionUser] r.Cookie error: %w", err)
+	}
+	claims, err := parseSessionToken(cookie.Value)
+	if err != nil {
+		return "", err
+	}
+	if claims.CustomClaims.User == "" {
+		return "", errors.New("invalid session token")
+	}
+	if revoked, err := isRevoked(_DB, claims.ID); err != nil || revoked {
+		return "", errors.New("session token is revoked")
+	}
+	return claims.CustomClaims.User, nil
+}
+
+// helper function to validate redirect URL used by login page, we only
+// allow redirects back to our own authorization end-point
+func loginRedirect(redirect string) string {
+	path := srvConfig.Config.Authz.WebServer.Base + "/oauth/authorize?"
+	if strings.HasPrefix(redirect, path) {
+		return redirect
+	}
+	return ""
+}
+
+// AuthorizeHandler provides access to GET /oauth/authorize end-point of
+// authorization code flow with PKCE
+func AuthorizeHandler(c *gin.Context) {
+	r := c.Request
+	// validate client and its redirect URI before we redirect anywhere
+	client, err := getClient(r.FormValue("client_id"))
+	if err != nil {
+		handleError(c, "unknown client", err)
+		return
+	}
+	redirectURI := r.FormValue("redirect_uri")
+	if !client.ValidRedirectURI(redirectURI) {
+		msg := fmt.Sprintf("redirect URI '%s' is not registered for client %s", redirectURI, client.ID)
+		handleError(c, "invalid redirect URI", errors.New(msg))
+		return
+	}
+	if _, err := clientAudience(client, requestAudience(r)); err != nil {
+		handleError(c, "invalid audience", err)
+		return
+	}
+	if err := _oauthServer.HandleAuthorizeRequest(c.Writer, r); err != nil {
+		handleError(c, "unable to process authorization request", err)
+	}
+}
+
+// authorizationCodeGrant handles grant_type=authorization_code requests of /oauth/token end-point
+func authorizationCodeGrant(c *gin.Context) {
+	r := c.Request
+	// invalid clients are rejected by oauth2 server, while bucket of the
+	// client is only charged once it is authenticated
+	if client, err := authenticateClient(r); err == nil && !allowClient(c, client) {
+		return
+	}
+	if err := _oauthServer.HandleTokenRequest(c.Writer, r); err != nil {
+		log.Println("ERROR: unable to handle token request", err)
+	}
+	// token errors are written by oauth2 server, we only record them here
+	if c.Writer.Status() != http.StatusOK {
+		clientId, _ := clientCredentials(r)
+		auditDenied(r, auditToken, "", clientId, r.FormValue("scope"), "authorization_code",
+			fmt.Errorf("token request failed with status %d", c.Writer.Status()))
+	}
+}
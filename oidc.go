@@ -0,0 +1,202 @@
+package main
+
+// OpenID Connect module
+//
+// It provides OpenID Connect discovery, JWKS and userinfo end-points and
+// issues id tokens signed by keyring keys, see
+// https://openid.net/specs/openid-connect-core-1_0.html
+// https://openid.net/specs/openid-connect-discovery-1_0.html
+//
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	authz "github.com/CHESSComputing/golib/authz"
+	srvConfig "github.com/CHESSComputing/golib/config"
+	"github.com/gin-gonic/gin"
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// JWK represents JSON Web Key, see RFC 7517 and RFC 8037
+type JWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS represents JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// helper function to return OpenID issuer
+func issuer() string {
+	if _config.Issuer != "" {
+		return strings.TrimSuffix(_config.Issuer, "/")
+	}
+	return strings.TrimSuffix(srvConfig.Config.Services.AuthzURL, "/")
+}
+
+// IDTokenClaims represents claims of OpenID Connect id token
+type IDTokenClaims struct {
+	jwt.RegisteredClaims
+	AuthTime          int64    `json:"auth_time,omitempty"`
+	Nonce             string   `json:"nonce,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Email             string   `json:"email,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	Btrs              []string `json:"btrs,omitempty"`
+	Scopes            []string `json:"scopes,omitempty"`
+}
+
+// helper function to generate id token for given user and client, id tokens
+// of Authz logins (empty client) are issued to Authz itself
+func idToken(user, clientId, nonce string, expires int64) (string, error) {
+	if expires == 0 {
+		expires = 3600
+	}
+	// Authz.ClientID is the key of HS512 access tokens and must never be
+	// disclosed via aud claim
+	audience := clientId
+	if audience == "" || audience == srvConfig.Config.Authz.ClientID {
+		audience = issuer()
+	}
+	now := time.Now()
+	claims := IDTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer(),
+			Subject:   user,
+			Audience:  jwt.ClaimStrings{audience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(expires) * time.Second)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        newTokenID(),
+		},
+		AuthTime:          now.Unix(),
+		Nonce:             nonce,
+		PreferredUsername: user,
+	}
+	if fuser, err := _foxdenUser.Get(user); err == nil {
+		claims.Groups = fuser.Groups
+		claims.Btrs = fuser.Btrs
+		claims.Scopes = fuser.Scopes
+	}
+	if email, err := _foxdenUser.GetEmail(user); err == nil {
+		claims.Email = email
+	}
+	return signToken(claims)
+}
+
+// helper function to add id token to given token map
+func addIDToken(tmap *TokenMap, user, clientId, nonce string) error {
+	token, err := idToken(user, clientId, nonce, tmap.Expires)
+	if err != nil {
+		return err
+	}
+	tmap.IDToken = token
+	return nil
+}
+
+// OpenIDConfiguration represents OpenID provider metadata
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSUri                           string   `json:"jwks_uri"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// OpenIDConfigurationHandler provides access to GET /.well-known/openid-configuration end-point
+func OpenIDConfigurationHandler(c *gin.Context) {
+	iss := issuer()
+	rec := OpenIDConfiguration{
+		Issuer:                            iss,
+		AuthorizationEndpoint:             iss + "/oauth/authorize",
+		TokenEndpoint:                     iss + "/oauth/token",
+		UserInfoEndpoint:                  iss + "/userinfo",
+		JWKSUri:                           iss + "/jwks.json",
+		IntrospectionEndpoint:             iss + "/oauth/introspect",
+		RevocationEndpoint:                iss + "/oauth/revoke",
+		DeviceAuthorizationEndpoint:       iss + "/oauth/device_authorization",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               supportedGrantTypes(),
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  _keyring.Algorithms(),
+		ScopesSupported:                   []string{"openid", "profile", "email", "read", "write", "delete"},
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "preferred_username", "email", "groups", "btrs", "scopes"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+	}
+	c.JSON(http.StatusOK, rec)
+}
+
+// JWKSHandler provides access to GET /jwks.json end-point
+func JWKSHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, _keyring.JWKS())
+}
+
+// UserInfo represents OpenID Connect userinfo response
+type UserInfo struct {
+	Subject           string   `json:"sub"`
+	PreferredUsername string   `json:"preferred_username"`
+	Email             string   `json:"email,omitempty"`
+	Groups            []string `json:"groups"`
+	Btrs              []string `json:"btrs"`
+	Scopes            []string `json:"scopes"`
+}
+
+// UserInfoHandler provides access to /userinfo end-point, it requires valid access token
+func UserInfoHandler(c *gin.Context) {
+	claims, err := parseToken(authz.BearerToken(c.Request))
+	if err == nil && claims.ID != "" {
+		if revoked, e := isRevoked(_DB, claims.ID); e != nil || revoked {
+			err = errors.New("token is revoked")
+		}
+	}
+	if err == nil && claims.CustomClaims.User == "" {
+		err = errors.New("token does not belong to a user")
+	}
+	if err != nil {
+		log.Println("ERROR: userinfo request with invalid token", err)
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		oauthError(c, http.StatusUnauthorized, "invalid_token", err.Error())
+		return
+	}
+	user := claims.CustomClaims.User
+	fuser, err := _foxdenUser.Get(user)
+	if err != nil {
+		oauthError(c, http.StatusNotFound, "invalid_token", fmt.Sprintf("no attributes for user %s", user))
+		return
+	}
+	rec := UserInfo{
+		Subject:           user,
+		PreferredUsername: user,
+		Groups:            fuser.Groups,
+		Btrs:              fuser.Btrs,
+		Scopes:            fuser.Scopes,
+	}
+	if email, err := _foxdenUser.GetEmail(user); err == nil {
+		rec.Email = email
+	}
+	c.JSON(http.StatusOK, rec)
+}
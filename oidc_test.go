@@ -0,0 +1,68 @@
+package main
+
+// OpenID Connect tests
+//
+import (
+	"encoding/json"
+	"testing"
+
+	srvConfig "github.com/CHESSComputing/golib/config"
+)
+
+// helper function to check that aud claim of id token does not disclose
+// key of HS512 access tokens
+func checkIDTokenAudience(t *testing.T, token, expected string) {
+	t.Helper()
+	var claims IDTokenClaims
+	if err := parseClaims(token, &claims); err != nil {
+		t.Fatal(err)
+	}
+	for _, aud := range claims.Audience {
+		if aud == srvConfig.Config.Authz.ClientID {
+			t.Fatalf("id token audience %v contains token signing secret", claims.Audience)
+		}
+	}
+	if len(claims.Audience) != 1 || claims.Audience[0] != expected {
+		t.Errorf("unexpected id token audience %v, expected %s", claims.Audience, expected)
+	}
+}
+
+// TestIDTokenAudience tests that id tokens are issued to OAuth client or to
+// Authz issuer and never to Authz.ClientID
+func TestIDTokenAudience(t *testing.T) {
+	setupKerberosTest(t)
+	srvConfig.Config.Services.AuthzURL = "https://authz.foxden.test"
+	if _config.SigningAlg != "" {
+		t.Fatal("test requires HS512 access tokens")
+	}
+
+	// Kerberos login via /oauth/authorize end-point
+	cl := testClient(t, testUser, testPassword)
+	apReq, err := KerberosAPReq(cl, testSPN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := KerberosRequest{APReq: apReq}
+	rec.User, rec.Scope = testUser, "read"
+	w := postJSON(t, "/oauth/authorize", rec)
+	checkToken(t, w, testUser)
+	var tmap TokenMap
+	if err := json.Unmarshal(w.Body.Bytes(), &tmap); err != nil {
+		t.Fatal(err)
+	}
+	checkIDTokenAudience(t, tmap.IDToken, issuer())
+
+	// id tokens of OAuth clients are issued to the client, while Authz
+	// client is replaced by issuer
+	for clientId, expected := range map[string]string{
+		"jupyterhub":                    "jupyterhub",
+		"":                              issuer(),
+		srvConfig.Config.Authz.ClientID: issuer(),
+	} {
+		token, err := idToken(testUser, clientId, "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkIDTokenAudience(t, token, expected)
+	}
+}
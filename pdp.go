@@ -0,0 +1,248 @@
+package main
+
+// policy decision point module
+//
+// FOXDEN services may ask Authz whether subject (user or token holder) is
+// allowed to perform an action on a resource via POST /authorize/check
+// end-point. The decision is based on access rules of scope policy file, e.g.
+//
+// rules:
+//   - action: delete
+//     resource: "*"
+//     groups: [foxdenadmin]
+//   - action: read
+//     resource: "btr:*"
+//     scopes: [read]
+//     btr: true
+//
+// Rules are evaluated in order and the first rule which matches action and
+// resource decides. The resource pattern may end with * to match resource
+// prefix. Resources which do not match any rule are denied. Subject scopes,
+// groups and btrs are taken from FOXDEN user attributes, the token only
+// identifies the user.
+//
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	authz "github.com/CHESSComputing/golib/authz"
+	services "github.com/CHESSComputing/golib/services"
+	utils "github.com/CHESSComputing/golib/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// maxCheckResources defines maximum number of resources of batch request
+const maxCheckResources = 1000
+
+// errCheckForbidden is returned when caller is not allowed to check access of the subject
+var errCheckForbidden = errors.New("not allowed to check access of other users")
+
+// AccessRule represents access rule of policy decision point
+type AccessRule struct {
+	Action   string   `yaml:"action" json:"action"`           // action or * for any action
+	Resource string   `yaml:"resource" json:"resource"`       // resource or resource pattern
+	Effect   string   `yaml:"effect" json:"effect,omitempty"` // allow (default) or deny
+	Scopes   []string `yaml:"scopes" json:"scopes,omitempty"` // subject must have all scopes
+	Groups   []string `yaml:"groups" json:"groups,omitempty"` // subject must belong to one of groups
+	Btr      bool     `yaml:"btr" json:"btr,omitempty"`       // resource BTR must belong to subject
+	Reason   string   `yaml:"reason" json:"reason,omitempty"` // optional reason of deny rule
+}
+
+// Subject represents subject of access check
+type Subject struct {
+	User   string
+	Scopes []string
+	Groups []string
+	Btrs   []string
+}
+
+// CheckRequest represents request of POST /authorize/check end-point, the
+// subject is given either by its token or by user name, and batch request
+// provides list of resources
+type CheckRequest struct {
+	Subject   string   `json:"subject,omitempty"`
+	Token     string   `json:"token,omitempty"`
+	Action    string   `json:"action"`
+	Resource  string   `json:"resource,omitempty"`
+	Resources []string `json:"resources,omitempty"`
+}
+
+// Decision represents access decision
+type Decision struct {
+	Resource string `json:"resource,omitempty"`
+	Allow    bool   `json:"allow"`
+	Reason   string `json:"reason"`
+}
+
+// helper function to match value against pattern, pattern * matches any
+// value and pattern with trailing * matches value prefix
+func matchPattern(pattern, value string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(value, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == value
+}
+
+// helper function to extract BTR of resource, the resource may be either
+// btr:<id> or path with btr=<id> component, e.g. /beamline=3a/btr=12345/cycle=2024-1
+func resourceBtr(resource string) string {
+	if strings.HasPrefix(resource, btrScopePrefix) {
+		return strings.TrimPrefix(resource, btrScopePrefix)
+	}
+	for _, part := range strings.Split(resource, "/") {
+		if strings.HasPrefix(part, "btr=") {
+			return strings.TrimPrefix(part, "btr=")
+		}
+	}
+	return ""
+}
+
+// helper function to validate access rules
+func validateRules(rules []AccessRule) error {
+	for i, rule := range rules {
+		if rule.Action == "" || rule.Resource == "" {
+			return fmt.Errorf("rule %d should define action and resource", i)
+		}
+		if rule.Effect != "" && rule.Effect != "allow" && rule.Effect != "deny" {
+			return fmt.Errorf("rule %d has invalid effect %s", i, rule.Effect)
+		}
+	}
+	return nil
+}
+
+// Decide evaluates access rules for given subject, action and resource
+func (p *ScopePolicy) Decide(subject Subject, action, resource string) Decision {
+	decision := Decision{Resource: resource}
+	for i, rule := range p.Rules {
+		if !matchPattern(rule.Action, action) || !matchPattern(rule.Resource, resource) {
+			continue
+		}
+		if rule.Effect == "deny" {
+			decision.Reason = fmt.Sprintf("denied by rule %d", i)
+			if rule.Reason != "" {
+				decision.Reason = rule.Reason
+			}
+			return decision
+		}
+		for _, s := range rule.Scopes {
+			if !utils.InList(s, subject.Scopes) {
+				decision.Reason = fmt.Sprintf("rule %d requires scope %s", i, s)
+				return decision
+			}
+		}
+		if len(rule.Groups) > 0 && !anyInList(rule.Groups, subject.Groups) {
+			decision.Reason = fmt.Sprintf("rule %d requires one of groups %v", i, rule.Groups)
+			return decision
+		}
+		if rule.Btr {
+			btr := resourceBtr(resource)
+			if btr == "" || !utils.InList(btr, subject.Btrs) {
+				decision.Reason = fmt.Sprintf("rule %d requires resource btr to belong to subject", i)
+				return decision
+			}
+		}
+		decision.Allow = true
+		decision.Reason = fmt.Sprintf("allowed by rule %d", i)
+		return decision
+	}
+	decision.Reason = "no matching rule"
+	return decision
+}
+
+// helper function to resolve subject of check request, the token only
+// identifies the user while scopes, groups and btrs of the subject always
+// come from FOXDEN user attributes, such that token and user name checks of
+// the same user lead to the same decision
+func checkSubject(c *gin.Context, req CheckRequest) (Subject, error) {
+	var subject Subject
+	user := req.Subject
+	if req.Token != "" {
+		claims, err := parseToken(req.Token)
+		if err == nil {
+			if revoked, e := isRevoked(_DB, claims.ID); e != nil || revoked {
+				err = errors.New("token is revoked")
+			}
+		}
+		if err == nil && claims.CustomClaims.User == "" {
+			err = errors.New("token does not belong to a user")
+		}
+		if err != nil {
+			return subject, err
+		}
+		user = claims.CustomClaims.User
+	} else if user == "" {
+		return subject, errors.New("either subject or token is required")
+	} else if val, ok := c.Get("claims"); ok {
+		// only FOXDEN services and admins may check access of other users
+		if claims, ok := val.(*authz.Claims); ok && claims.CustomClaims.User != user &&
+			!isAdmin(claims) && !utils.InList(claims.CustomClaims.Kind, []string{"client", "client_credentials"}) {
+			return subject, errCheckForbidden
+		}
+	}
+	fuser, err := _foxdenUser.Get(user)
+	if err != nil {
+		return subject, fmt.Errorf("no foxden user found, error: %w", err)
+	}
+	subject.User = user
+	subject.Scopes = fuser.Scopes
+	subject.Groups = fuser.Groups
+	subject.Btrs = fuser.Btrs
+	return subject, nil
+}
+
+// AuthorizeCheckHandler provides access to POST /authorize/check end-point
+func AuthorizeCheckHandler(c *gin.Context) {
+	var req CheckRequest
+	defer c.Request.Body.Close()
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		rec := services.Response("Authz", http.StatusBadRequest, services.ReaderError, err)
+		c.JSON(http.StatusBadRequest, rec)
+		return
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		rec := services.Response("Authz", http.StatusBadRequest, services.UnmarshalError, err)
+		c.JSON(http.StatusBadRequest, rec)
+		return
+	}
+	if req.Action == "" || (req.Resource == "") == (len(req.Resources) == 0) {
+		err := errors.New("action and either resource or resources are required")
+		rec := services.Response("Authz", http.StatusBadRequest, services.ParametersError, err)
+		c.JSON(http.StatusBadRequest, rec)
+		return
+	}
+	if len(req.Resources) > maxCheckResources {
+		err := fmt.Errorf("too many resources, maximum is %d", maxCheckResources)
+		rec := services.Response("Authz", http.StatusBadRequest, services.ParametersError, err)
+		c.JSON(http.StatusBadRequest, rec)
+		return
+	}
+	subject, err := checkSubject(c, req)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errCheckForbidden) {
+			status = http.StatusForbidden
+		}
+		rec := services.Response("Authz", status, services.AuthError, err)
+		c.JSON(status, rec)
+		return
+	}
+	if req.Resource != "" {
+		decision := _policy.Decide(subject, req.Action, req.Resource)
+		decision.Resource = ""
+		c.JSON(http.StatusOK, decision)
+		return
+	}
+	decisions := make([]Decision, 0, len(req.Resources))
+	for _, resource := range req.Resources {
+		decisions = append(decisions, _policy.Decide(subject, req.Action, resource))
+	}
+	c.JSON(http.StatusOK, gin.H{"decisions": decisions})
+}
@@ -0,0 +1,48 @@
+package main
+
+// policy decision point tests
+//
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	authz "github.com/CHESSComputing/golib/authz"
+	"github.com/gin-gonic/gin"
+)
+
+// TestCheckSubject tests that subject given by token and by user name leads
+// to the same decision even when token scope differs from user attributes
+func TestCheckSubject(t *testing.T) {
+	setupKerberosTest(t)
+	_policy.Rules = []AccessRule{
+		{Action: "write", Resource: "*", Scopes: []string{"write"}},
+		{Action: "read", Resource: "*", Scopes: []string{"read"}},
+	}
+	tmap, err := newAccessToken(authz.AuthUser{Name: testUser, Scope: "read+write", Kind: "user", App: "Authz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	byToken, err := checkSubject(c, CheckRequest{Token: tmap.AccessToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName, err := checkSubject(c, CheckRequest{Subject: testUser})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(byToken, byName) {
+		t.Fatalf("token subject %+v differs from user subject %+v", byToken, byName)
+	}
+	for _, action := range []string{"read", "write"} {
+		d1 := _policy.Decide(byToken, action, "/data")
+		d2 := _policy.Decide(byName, action, "/data")
+		if d1 != d2 {
+			t.Errorf("action %s: token decision %+v, user decision %+v", action, d1, d2)
+		}
+	}
+	if d := _policy.Decide(byToken, "write", "/data"); d.Allow {
+		t.Error("token scope grants write access not present in user attributes")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+// scope policy module
+//
+// The scope policy defines which user attributes are required to obtain token
+// with given scope. It is read from YAML or JSON file defined by
+// Authz.ScopePolicy configuration option, e.g.
+//
+// scopes:
+//   write:
+//     groups: [foxdenrw]
+//   delete:
+//     groups: [foxdenadmin]
+//   beamline:
+//     btrs: [btr1, btr2]
+//     attributes:
+//       foxden_groups: [chess]
+//
+// Every scope of the request is evaluated independently. The user must satisfy
+// all fields of scope rule, where every field is satisfied if user has any of
+// its values. Scopes without rules are allowed to all FOXDEN users.
+//
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	services "github.com/CHESSComputing/golib/services"
+	utils "github.com/CHESSComputing/golib/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// ScopeRule represents user attributes required by given scope
+type ScopeRule struct {
+	Groups     []string            `yaml:"groups" json:"groups,omitempty"`         // user must belong to one of groups
+	Btrs       []string            `yaml:"btrs" json:"btrs,omitempty"`             // user must have one of btrs
+	Attributes map[string][]string `yaml:"attributes" json:"attributes,omitempty"` // user attribute must have one of values
+}
+
+// ScopePolicy represents mapping of scopes to their rules along with access
+// rules of policy decision point (see pdp.go)
+type ScopePolicy struct {
+	Scopes map[string]ScopeRule `yaml:"scopes" json:"scopes"`
+	Rules  []AccessRule         `yaml:"rules" json:"rules,omitempty"`
+}
+
+// _policy holds scope policy of Authz server
+var _policy = defaultPolicy()
+
+// helper function to return default scope policy, i.e. write scope requires
+// foxdenrw group and delete scope requires foxdenadmin group
+func defaultPolicy() ScopePolicy {
+	return ScopePolicy{
+		Scopes: map[string]ScopeRule{
+			"write":  {Groups: []string{"foxdenrw"}},
+			"delete": {Groups: []string{"foxdenadmin"}},
+		},
+	}
+}
+
+// helper function to return values of given user attribute
+func userAttribute(fuser services.User, name string) ([]string, error) {
+	switch strings.ToLower(name) {
+	case "groups":
+		return fuser.Groups, nil
+	case "btrs":
+		return fuser.Btrs, nil
+	case "scopes":
+		return fuser.Scopes, nil
+	case "foxden_groups", "foxdengroups":
+		return fuser.FoxdenGroups, nil
+	}
+	return nil, fmt.Errorf("unsupported user attribute %s", name)
+}
+
+// helper function to check if any of values is present in given list
+func anyInList(values, list []string) bool {
+	for _, v := range values {
+		if utils.InList(v, list) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check checks that user attributes satisfy rules of every given scope
+func (p *ScopePolicy) Check(fuser services.User, scope string) error {
+	for _, s := range scopes(scope) {
+		rule, ok := p.Scopes[s]
+		if !ok {
+			continue
+		}
+		if len(rule.Groups) > 0 && !anyInList(rule.Groups, fuser.Groups) {
+			return fmt.Errorf("scope %s requires one of groups %v", s, rule.Groups)
+		}
+		if len(rule.Btrs) > 0 && !anyInList(rule.Btrs, fuser.Btrs) {
+			return fmt.Errorf("scope %s requires one of btrs %v", s, rule.Btrs)
+		}
+		// sort attribute names to report errors in stable order
+		var names []string
+		for name := range rule.Attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			values := rule.Attributes[name]
+			attrs, err := userAttribute(fuser, name)
+			if err != nil {
+				return err
+			}
+			if len(values) > 0 && !anyInList(values, attrs) {
+				return fmt.Errorf("scope %s requires one of %s %v", s, name, values)
+			}
+		}
+	}
+	return nil
+}
+
+// helper function to validate scope policy
+func (p *ScopePolicy) validate() error {
+	if len(p.Scopes) == 0 && len(p.Rules) == 0 {
+		return errors.New("policy does not define any scope or rule")
+	}
+	if err := validateRules(p.Rules); err != nil {
+		return err
+	}
+	for s, rule := range p.Scopes {
+		for name := range rule.Attributes {
+			if _, err := userAttribute(services.User{}, name); err != nil {
+				return fmt.Errorf("scope %s: %w", s, err)
+			}
+		}
+	}
+	return nil
+}
+
+// helper function to load scope policy from YAML or JSON file, the file
+// format is defined by file extension, scope names and attribute keys are
+// kept as is
+func loadPolicy(fname string) (ScopePolicy, error) {
+	var policy ScopePolicy
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return policy, fmt.Errorf("[Authz.main.loadPolicy] os.ReadFile error: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(fname)) {
+	case ".json":
+		if err := json.Unmarshal(data, &policy); err != nil {
+			return policy, fmt.Errorf("[Authz.main.loadPolicy] json.Unmarshal error: %w", err)
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &policy); err != nil {
+			return policy, fmt.Errorf("[Authz.main.loadPolicy] yaml.Unmarshal error: %w", err)
+		}
+	default:
+		return policy, fmt.Errorf("[Authz.main.loadPolicy] unsupported policy file %s, should be YAML or JSON", fname)
+	}
+	if err := policy.validate(); err != nil {
+		return policy, fmt.Errorf("[Authz.main.loadPolicy] invalid policy %s: %w", fname, err)
+	}
+	// policy without scopes section (e.g. with access rules only) keeps
+	// default scope requirements, while explicitly empty scopes drop them
+	if policy.Scopes == nil {
+		policy.Scopes = defaultPolicy().Scopes
+	} else if len(policy.Scopes) == 0 {
+		log.Printf("WARNING: scope policy %s does not restrict any scope, write and delete scopes are allowed to all FOXDEN users", fname)
+	}
+	return policy, nil
+}
+
+// helper function to initialize scope policy of Authz server
+func initPolicy() error {
+	if _config.ScopePolicy == "" {
+		return nil
+	}
+	policy, err := loadPolicy(_config.ScopePolicy)
+	if err != nil {
+		return err
+	}
+	_policy = policy
+	log.Printf("INFO: loaded scope policy %s with %d scopes and %d rules", _config.ScopePolicy, len(policy.Scopes), len(policy.Rules))
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+// scope policy tests
+//
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	services "github.com/CHESSComputing/golib/services"
+)
+
+// TestLoadPolicy tests that scope names with dots and upper case letters
+// are kept as is in YAML and JSON policies
+func TestLoadPolicy(t *testing.T) {
+	policies := map[string]string{
+		"policy.yaml": `
+scopes:
+  beamline.ID3A:
+    groups: [ID3A]
+    attributes:
+      foxden_groups: [chess]
+`,
+		"policy.json": `{"scopes": {"beamline.ID3A": {"groups": ["ID3A"], "attributes": {"foxden_groups": ["chess"]}}}}`,
+	}
+	for fname, content := range policies {
+		t.Run(fname, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), fname)
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			policy, err := loadPolicy(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rule, ok := policy.Scopes["beamline.ID3A"]
+			if !ok {
+				t.Fatalf("scope beamline.ID3A is not found in %+v", policy.Scopes)
+			}
+			if len(rule.Groups) != 1 || rule.Groups[0] != "ID3A" {
+				t.Errorf("unexpected groups %v", rule.Groups)
+			}
+			fuser := services.User{Groups: []string{"ID3A"}, FoxdenGroups: []string{"chess"}}
+			if err := policy.Check(fuser, "beamline.ID3A"); err != nil {
+				t.Error(err)
+			}
+			if err := policy.Check(services.User{Groups: []string{"ID3A"}}, "beamline.ID3A"); err == nil {
+				t.Error("user without foxden group is allowed")
+			}
+		})
+	}
+}
+
+// TestLoadPolicyRules tests that policy without scopes section keeps default
+// scope requirements
+func TestLoadPolicyRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	content := `
+rules:
+  - action: delete
+    resource: "*"
+    groups: [foxdenadmin]
+`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := loadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Rules) != 1 {
+		t.Fatalf("unexpected rules %+v", policy.Rules)
+	}
+	fuser := services.User{Groups: []string{"chess"}}
+	for _, scope := range []string{"write", "delete"} {
+		if err := policy.Check(fuser, scope); err == nil {
+			t.Errorf("scope %s is allowed to user without required group", scope)
+		}
+	}
+}
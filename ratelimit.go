@@ -0,0 +1,190 @@
+package main
+
+// rate limit module
+//
+// Token end-points (/oauth/token, /oauth/authorize and /oauth/trusted) are
+// protected by token-bucket rate limits keyed by client IP, OAuth client ID
+// and user. Every key has its own bucket which is refilled with given rate
+// (requests per second) up to its burst size. Requests exceeding the limit
+// are rejected with HTTP 429 and Retry-After header. Limits are configured in
+// Authz section, while registered clients may have their own quotas, e.g.
+//
+// Authz:
+//   RateLimits:
+//     IP: {Rate: 20, Burst: 100}
+//     Client: {Rate: 10, Burst: 50}
+//     User: {Rate: 5, Burst: 20}
+//
+// Client and user buckets are charged only once the client is authenticated
+// and user credentials are verified, such that anonymous callers can't drain
+// quota of others by naming them, unauthenticated requests are limited by IP.
+// Buckets are kept in memory of every Authz replica.
+//
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// rate limit kinds
+const (
+	rateIP     = "ip"
+	rateClient = "client"
+	rateUser   = "user"
+)
+
+// RateLimit represents token-bucket rate limit, zero values imply default
+// limit and negative rate disables the limit
+type RateLimit struct {
+	Rate  float64 `mapstructure:"Rate" json:"rate"`   // requests per second
+	Burst int     `mapstructure:"Burst" json:"burst"` // bucket size
+}
+
+// RateLimits represents rate limits of token end-points
+type RateLimits struct {
+	IP     RateLimit `mapstructure:"IP"`
+	Client RateLimit `mapstructure:"Client"`
+	User   RateLimit `mapstructure:"User"`
+}
+
+// default rate limits
+var defaultRateLimits = map[string]RateLimit{
+	rateIP:     {Rate: 20, Burst: 100},
+	rateClient: {Rate: 10, Burst: 50},
+	rateUser:   {Rate: 5, Burst: 20},
+}
+
+// helper function to return rate limit of given kind, client quota takes
+// precedence over configured limit
+func rateLimit(kind string, quota RateLimit) RateLimit {
+	limit := quota
+	if limit.Rate == 0 {
+		switch kind {
+		case rateIP:
+			limit = _config.RateLimits.IP
+		case rateClient:
+			limit = _config.RateLimits.Client
+		case rateUser:
+			limit = _config.RateLimits.User
+		}
+	}
+	if limit.Rate == 0 {
+		limit.Rate = defaultRateLimits[kind].Rate
+	}
+	if limit.Burst <= 0 {
+		limit.Burst = defaultRateLimits[kind].Burst
+	}
+	return limit
+}
+
+// rateBucket represents token bucket of the key
+type rateBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter keeps token buckets of rate limit keys
+type rateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+// _rateLimiter holds token buckets of Authz
+var _rateLimiter = &rateLimiter{buckets: make(map[string]*rateBucket)}
+
+// reserve takes token from the bucket of given key, it returns zero if
+// request is allowed or duration to wait until request is allowed
+func (l *rateLimiter) reserve(key string, limit RateLimit) time.Duration {
+	if limit.Rate < 0 {
+		return 0
+	}
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &rateBucket{limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)}
+		l.buckets[key] = bucket
+	}
+	// apply changes of client quotas
+	if bucket.limiter.Limit() != rate.Limit(limit.Rate) {
+		bucket.limiter.SetLimitAt(now, rate.Limit(limit.Rate))
+	}
+	if bucket.limiter.Burst() != limit.Burst {
+		bucket.limiter.SetBurstAt(now, limit.Burst)
+	}
+	bucket.lastSeen = now
+	res := bucket.limiter.ReserveN(now, 1)
+	if !res.OK() {
+		return time.Second
+	}
+	delay := res.DelayFrom(now)
+	if delay > 0 {
+		// rejected requests do not consume tokens
+		res.CancelAt(now)
+	}
+	return delay
+}
+
+// cleanup removes buckets which were not used for given period
+func (l *rateLimiter) cleanup(idle time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for key, bucket := range l.buckets {
+		if time.Since(bucket.lastSeen) > idle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// helper function to check rate limit of given kind and name, it writes
+// 429 response and returns false if request exceeds the limit
+func allowRequest(c *gin.Context, kind, name string, quota RateLimit) bool {
+	if name == "" {
+		return true
+	}
+	delay := _rateLimiter.reserve(kind+":"+name, rateLimit(kind, quota))
+	if delay <= 0 {
+		return true
+	}
+	retry := int64(math.Ceil(delay.Seconds()))
+	if Verbose > 0 {
+		log.Printf("WARNING: %s %s exceeds rate limit, retry after %d seconds", kind, name, retry)
+	}
+	c.Header("Retry-After", strconv.FormatInt(retry, 10))
+	desc := fmt.Sprintf("too many requests of %s %s, retry after %d seconds", kind, name, retry)
+	c.Set("failed", "rate_limited")
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, OAuthError{Error: "rate_limited", Description: desc})
+	return false
+}
+
+// helper function to check rate limit of the user, it should be called once
+// user credentials are verified
+func allowUser(c *gin.Context, user string) bool {
+	return allowRequest(c, rateUser, user, RateLimit{})
+}
+
+// helper function to check rate limit of the OAuth client, it should be
+// called once client is authenticated
+func allowClient(c *gin.Context, client *Client) bool {
+	return allowRequest(c, rateClient, client.ID, client.RateLimit)
+}
+
+// rateLimited wraps gin handler of token end-point with rate limit of client
+// IP. It does not read request body which is consumed by handlers, while
+// client and user limits are checked by handlers once they authenticate them
+func rateLimited(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !allowRequest(c, rateIP, getIP(c.Request), RateLimit{}) {
+			return
+		}
+		handler(c)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+// rate limit tests
+//
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRateLimitedBody tests that rate limits do not consume request body of
+// /oauth/authorize end-point, e.g. curl -d sends form content type
+func TestRateLimitedBody(t *testing.T) {
+	setupKerberosTest(t)
+	cl := testClient(t, testUser, testPassword)
+	apReq, err := KerberosAPReq(cl, testSPN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := KerberosRequest{APReq: apReq}
+	rec.User, rec.Scope = testUser, "read"
+	data, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/oauth/authorize", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	checkToken(t, serve(req), testUser)
+}
+
+// TestRateLimitedUser tests that unauthenticated requests naming the user do
+// not exhaust its quota
+func TestRateLimitedUser(t *testing.T) {
+	setupKerberosTest(t)
+	burst := rateLimit(rateUser, RateLimit{}).Burst
+	rec := KerberosRequest{APReq: []byte("bogus")}
+	rec.User, rec.Scope = testUser, "read"
+	for i := 0; i <= burst; i++ {
+		if w := postJSON(t, "/oauth/authorize", rec); w.Code != http.StatusBadRequest {
+			t.Fatalf("bogus AP-REQ: unexpected status %d", w.Code)
+		}
+	}
+	cl := testClient(t, testUser, testPassword)
+	apReq, err := KerberosAPReq(cl, testSPN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.APReq = apReq
+	checkToken(t, postJSON(t, "/oauth/authorize", rec), testUser)
+}
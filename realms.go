@@ -0,0 +1,186 @@
+package main
+
+// Kerberos realms module
+//
+// Authz accepts users of multiple Kerberos realms (e.g. CLASSE, CORNELL.EDU
+// and partner labs with cross-realm trust). Every realm has its own krb5.conf,
+// optional list of KDCs which overrides the one in krb5.conf, and rules to
+// map Kerberos principal to FOXDEN user name, e.g.
+//
+// Authz:
+//   KerberosRealms:
+//     - Realm: CLASSE.CORNELL.EDU
+//       Krb5Conf: /etc/krb5.conf
+//     - Realm: CORNELL.EDU
+//       KDCs: ["kerberos.cornell.edu:88"]
+//       Mapping: [strip_realm, lowercase]
+//     - Realm: PARTNER.ORG
+//       Krb5Conf: /etc/krb5.partner.conf
+//       Mapping: [lowercase]
+//       Aliases:
+//         jdoe@partner.org: johndoe
+//
+// Mapping rules are applied in order: strip_realm drops @REALM suffix of the
+// principal, strip_instance drops its /instance part and lowercase converts it
+// to lower case. Without mapping rules the realm is stripped, and explicit
+// aliases of principal (user@realm) take precedence over the rules. The first
+// realm is used for password logins without realm. Without KerberosRealms
+// the realm and krb5.conf of Kerberos section of FOXDEN configuration are used.
+//
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	srvConfig "github.com/CHESSComputing/golib/config"
+	"gopkg.in/jcmturner/gokrb5.v7/config"
+	"gopkg.in/jcmturner/gokrb5.v7/credentials"
+)
+
+// principal mapping rules
+const (
+	mapStripRealm    = "strip_realm"
+	mapStripInstance = "strip_instance"
+	mapLowercase     = "lowercase"
+)
+
+// KerberosRealm represents Kerberos realm accepted by Authz
+type KerberosRealm struct {
+	Realm    string            `mapstructure:"Realm"`    // realm name, e.g. CLASSE.CORNELL.EDU
+	Krb5Conf string            `mapstructure:"Krb5Conf"` // krb5.conf of the realm, by default Kerberos.Krb5Conf
+	KDCs     []string          `mapstructure:"KDCs"`     // KDC addresses overriding krb5.conf
+	Mapping  []string          `mapstructure:"Mapping"`  // principal to FOXDEN user mapping rules
+	Aliases  map[string]string `mapstructure:"Aliases"`  // explicit principal to FOXDEN user aliases
+}
+
+// helper function to validate Kerberos realms configuration
+func validateRealms(realms []KerberosRealm) error {
+	seen := make(map[string]bool)
+	for _, realm := range realms {
+		if realm.Realm == "" {
+			return errors.New("kerberos realm name is not provided")
+		}
+		if seen[realm.Realm] {
+			return fmt.Errorf("kerberos realm %s is defined more than once", realm.Realm)
+		}
+		seen[realm.Realm] = true
+		for _, rule := range realm.Mapping {
+			if rule != mapStripRealm && rule != mapStripInstance && rule != mapLowercase {
+				return fmt.Errorf("unknown mapping rule %s of kerberos realm %s", rule, realm.Realm)
+			}
+		}
+	}
+	return nil
+}
+
+// helper function to return Kerberos realms accepted by Authz
+func kerberosRealms() []KerberosRealm {
+	if len(_config.KerberosRealms) > 0 {
+		return _config.KerberosRealms
+	}
+	if srvConfig.Config.Kerberos.Realm == "" {
+		return nil
+	}
+	return []KerberosRealm{{Realm: srvConfig.Config.Kerberos.Realm}}
+}
+
+// helper function to find configuration of given Kerberos realm
+func findRealm(name string) (KerberosRealm, error) {
+	realms := kerberosRealms()
+	if len(realms) == 0 {
+		// Authz without configured realms accepts any realm of its krb5.conf
+		return KerberosRealm{Realm: name}, nil
+	}
+	for _, realm := range realms {
+		if realm.Realm == name {
+			return realm, nil
+		}
+	}
+	return KerberosRealm{}, fmt.Errorf("kerberos realm %s is not allowed", name)
+}
+
+// helper function to split login name into principal and realm, login
+// without realm belongs to the first configured realm
+func splitLogin(login string) (string, KerberosRealm, error) {
+	if idx := strings.LastIndex(login, "@"); idx > 0 {
+		realm, err := findRealm(login[idx+1:])
+		return login[:idx], realm, err
+	}
+	realms := kerberosRealms()
+	if len(realms) == 0 {
+		return login, KerberosRealm{Realm: srvConfig.Config.Kerberos.Realm}, nil
+	}
+	return login, realms[0], nil
+}
+
+// krb5Config loads krb5.conf of the realm and applies its KDCs
+func (k KerberosRealm) krb5Config() (*config.Config, error) {
+	fname := k.Krb5Conf
+	if fname == "" {
+		fname = srvConfig.Config.Kerberos.Krb5Conf
+	}
+	cfg := config.NewConfig()
+	if fname != "" {
+		var err error
+		if cfg, err = config.Load(fname); err != nil {
+			return nil, fmt.Errorf("[Authz.main.krb5Config] config.Load error: %w", err)
+		}
+	} else if len(k.KDCs) == 0 {
+		return nil, fmt.Errorf("neither krb5.conf nor KDCs of kerberos realm %s are configured", k.Realm)
+	}
+	if cfg.LibDefaults.DefaultRealm == "" {
+		cfg.LibDefaults.DefaultRealm = k.Realm
+	}
+	if len(k.KDCs) > 0 {
+		found := false
+		for i := range cfg.Realms {
+			if cfg.Realms[i].Realm == k.Realm {
+				cfg.Realms[i].KDC = k.KDCs
+				found = true
+			}
+		}
+		if !found {
+			cfg.Realms = append(cfg.Realms, config.Realm{Realm: k.Realm, KDC: k.KDCs})
+		}
+		// do not look up KDCs of the realm in DNS
+		cfg.LibDefaults.DNSLookupKDC = false
+	}
+	return cfg, nil
+}
+
+// username maps Kerberos principal (without realm) to FOXDEN user name
+func (k KerberosRealm) username(principal string) string {
+	// viper lower cases map keys, therefore aliases are case insensitive
+	full := strings.ToLower(principal + "@" + k.Realm)
+	if user, ok := k.Aliases[full]; ok {
+		return user
+	}
+	rules := k.Mapping
+	if len(rules) == 0 {
+		rules = []string{mapStripRealm}
+	}
+	user, realm := principal, "@"+k.Realm
+	for _, rule := range rules {
+		switch rule {
+		case mapStripRealm:
+			realm = ""
+		case mapStripInstance:
+			if idx := strings.Index(user, "/"); idx > 0 {
+				user = user[:idx]
+			}
+		case mapLowercase:
+			user, realm = strings.ToLower(user), strings.ToLower(realm)
+		}
+	}
+	return user + realm
+}
+
+// helper function to map authenticated Kerberos credentials to FOXDEN user,
+// it returns user name and its realm
+func kerberosUser(creds *credentials.Credentials) (string, string, error) {
+	realm, err := findRealm(creds.Domain())
+	if err != nil {
+		return "", "", err
+	}
+	return realm.username(creds.UserName()), realm.Realm, nil
+}
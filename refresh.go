@@ -0,0 +1,328 @@
+package main
+
+// refresh token module
+//
+// Refresh tokens are rotated on every use, i.e. each refresh request
+// invalidates used refresh token and issues new one within the same token
+// family. If already used refresh token is presented again we consider it
+// as token theft and revoke the whole token family, see RFC 6819 section 5.2.2.3
+//
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	srvConfig "github.com/CHESSComputing/golib/config"
+	utils "github.com/CHESSComputing/golib/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// RefreshToken represents refresh_tokens table
+type RefreshToken struct {
+	ID      uint   `json:"id"`
+	TOKEN   string `json:"token"` // sha256 hash of refresh token
+	FAMILY  string `json:"family"`
+	LOGIN   string `json:"login"`
+	CLIENT  string `json:"client_id"` // OAuth client the token is issued to, empty for Authz logins
+	SCOPE   string `json:"scope"`
+	KIND    string `json:"kind"`
+	JTI     string `json:"jti"`         // ID of access token issued along with refresh token
+	JTI_EXP int64  `json:"jti_expires"` // expiration time of access token
+	AUD     string `json:"audience"`    // space separated audience of access token
+	REALM   string `json:"realm"`       // Kerberos realm of the user
+	USED    bool   `json:"used"`
+	REVOKED bool   `json:"revoked"`
+	EXPIRES int64  `json:"expires"`
+	CREATED int64  `json:"created"`
+}
+
+// helper function to generate random token string
+func randomToken(size int) (string, error) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return "", fmt.Errorf("[Authz.main.randomToken] rand.Read error: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// helper function to hash given token, we never store tokens in plain form
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// getRefreshToken retrieves refresh token record for given refresh token
+func getRefreshToken(db *sql.DB, token string) (RefreshToken, error) {
+	var rec RefreshToken
+	query := "SELECT id, token, family, login, client_id, scope, kind, jti, jti_expires, audience, realm, used, revoked, expires, created FROM refresh_tokens WHERE token = ?"
+	err := db.QueryRow(query, hashToken(token)).Scan(
+		&rec.ID,
+		&rec.TOKEN,
+		&rec.FAMILY,
+		&rec.LOGIN,
+		&rec.CLIENT,
+		&rec.SCOPE,
+		&rec.KIND,
+		&rec.JTI,
+		&rec.JTI_EXP,
+		&rec.AUD,
+		&rec.REALM,
+		&rec.USED,
+		&rec.REVOKED,
+		&rec.EXPIRES,
+		&rec.CREATED)
+	if err == sql.ErrNoRows {
+		return rec, errors.New("refresh token is not found")
+	} else if err != nil {
+		log.Println("ERROR: failed to query refresh token:", err)
+		return rec, fmt.Errorf("[Authz.main.getRefreshToken] row.Scan error: %w", err)
+	}
+	return rec, nil
+}
+
+// createRefreshToken creates new refresh token within given token family,
+// if family is empty new token family is started
+func createRefreshToken(db *sql.DB, family, login, clientId, scope, kind, jti string, jtiExpires int64, audience []string, realm string) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	if family == "" {
+		family = newTokenID()
+	}
+	now := time.Now().Unix()
+	expires := now + _config.RefreshTokenExpires
+	query := `
+	INSERT INTO refresh_tokens (token, family, login, client_id, scope, kind, jti, jti_expires, audience, realm, used, revoked, expires, created)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err = db.Exec(query, hashToken(token), family, login, clientId, scope, kind, jti, jtiExpires,
+		strings.Join(audience, " "), realm, false, false, expires, now)
+	if err != nil {
+		log.Println("ERROR: failed to create refresh token:", err)
+		return "", fmt.Errorf("[Authz.main.createRefreshToken] db.Exec error: %w", err)
+	}
+	return token, nil
+}
+
+// useRefreshToken marks refresh token as used, it returns false if token
+// was already used (e.g. by concurrent request)
+func useRefreshToken(db *sql.DB, id uint) (bool, error) {
+	query := "UPDATE refresh_tokens SET used = ? WHERE id = ? AND used = ?"
+	result, err := db.Exec(query, true, id, false)
+	if err != nil {
+		return false, fmt.Errorf("[Authz.main.useRefreshToken] db.Exec error: %w", err)
+	}
+	nrows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("[Authz.main.useRefreshToken] result.RowsAffected error: %w", err)
+	}
+	return nrows == 1, nil
+}
+
+// revokeTokenFamily revokes all refresh tokens of given family along with
+// access tokens issued by them
+func revokeTokenFamily(db *sql.DB, family string) error {
+	query := "SELECT login, jti, jti_expires FROM refresh_tokens WHERE family = ?"
+	rows, err := db.Query(query, family)
+	if err != nil {
+		return fmt.Errorf("[Authz.main.revokeTokenFamily] db.Query error: %w", err)
+	}
+	type accessToken struct {
+		login   string
+		jti     string
+		expires int64
+	}
+	var tokens []accessToken
+	for rows.Next() {
+		var t accessToken
+		if err := rows.Scan(&t.login, &t.jti, &t.expires); err != nil {
+			rows.Close()
+			return fmt.Errorf("[Authz.main.revokeTokenFamily] rows.Scan error: %w", err)
+		}
+		tokens = append(tokens, t)
+	}
+	rows.Close()
+	for _, t := range tokens {
+		if t.jti == "" || t.expires < time.Now().Unix() {
+			continue
+		}
+		if err := revokeToken(db, t.jti, t.login, t.expires); err != nil {
+			return err
+		}
+	}
+	query = "UPDATE refresh_tokens SET revoked = ? WHERE family = ?"
+	if _, err := db.Exec(query, true, family); err != nil {
+		return fmt.Errorf("[Authz.main.revokeTokenFamily] db.Exec error: %w", err)
+	}
+	log.Printf("WARNING: revoked refresh token family %s", family)
+	return nil
+}
+
+// cleanupRefreshTokens removes expired refresh tokens
+func cleanupRefreshTokens(db *sql.DB) error {
+	query := "DELETE FROM refresh_tokens WHERE expires < ?"
+	if _, err := db.Exec(query, time.Now().Unix()); err != nil {
+		return fmt.Errorf("[Authz.main.cleanupRefreshTokens] db.Exec error: %w", err)
+	}
+	return nil
+}
+
+// helper function to issue refresh token for given token map, the refresh
+// token keeps audience of access token and is bound to given OAuth client
+func addRefreshToken(tmap *TokenMap, family, user, clientId, scope, kind string) error {
+	expires := time.Now().Unix() + tmap.Expires
+	token, err := createRefreshToken(_DB, family, user, clientId, scope, kind, tmap.TokenID, expires, tmap.Audience, tmap.Realm)
+	if err != nil {
+		return err
+	}
+	tmap.RefreshToken = token
+	return nil
+}
+
+// helper function to re-check user attributes of refresh token owner
+func checkRefreshUser(rec RefreshToken) error {
+	if rec.KIND == "trusted_client" {
+		trusted := false
+		for _, tuser := range srvConfig.Config.TrustedUsers {
+			if tuser.User == rec.LOGIN {
+				trusted = true
+			}
+		}
+		if !trusted {
+			return fmt.Errorf("user %s is not in trusted list", rec.LOGIN)
+		}
+	}
+	if _, err := checkUserScope(rec.LOGIN, rec.SCOPE); err != nil {
+		return err
+	}
+	return nil
+}
+
+// helper function to authenticate client of refresh token request, refresh
+// token can only be used by the client it was issued to, public clients are
+// identified by client_id, and tokens of Authz logins are not issued to any
+// client (nil client is returned)
+func refreshClient(r *http.Request, rec RefreshToken) (*Client, error) {
+	if rec.CLIENT == "" {
+		if clientId, _ := clientCredentials(r); clientId != "" {
+			return nil, errors.New("refresh token was issued to another client")
+		}
+		return nil, nil
+	}
+	client, err := authenticateClient(r)
+	if err != nil || client.ID != rec.CLIENT {
+		return nil, errors.New("refresh token was issued to another client")
+	}
+	return client, nil
+}
+
+// helper function to revoke refresh token along with its token family, the
+// token issued to OAuth client can only be revoked by the client, see RFC 7009
+func revokeRefreshToken(c *gin.Context, rec RefreshToken) {
+	if _, err := refreshClient(c.Request, rec); err != nil {
+		oauthError(c, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+	if err := revokeTokenFamily(_DB, rec.FAMILY); err != nil {
+		log.Println("ERROR:", err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "unable to revoke refresh token")
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// refreshTokenGrant handles grant_type=refresh_token requests of /oauth/token end-point
+func refreshTokenGrant(c *gin.Context) {
+	r := c.Request
+	token := r.FormValue("refresh_token")
+	if token == "" {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "refresh_token parameter is required")
+		return
+	}
+	rec, err := getRefreshToken(_DB, token)
+	if err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+	if rec.REVOKED {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "refresh token is revoked")
+		return
+	}
+	if rec.EXPIRES < time.Now().Unix() {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "refresh token is expired")
+		return
+	}
+	client, err := refreshClient(r, rec)
+	if err != nil {
+		oauthError(c, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+	if client != nil && !allowClient(c, client) {
+		return
+	}
+	if !allowUser(c, rec.LOGIN) {
+		return
+	}
+	// rotate refresh token, the reuse of already used token revokes whole token family
+	used, err := useRefreshToken(_DB, rec.ID)
+	if err == nil && !used {
+		log.Printf("WARNING: reuse of refresh token detected, user=%s family=%s IP=%s", rec.LOGIN, rec.FAMILY, getIP(r))
+		err = revokeTokenFamily(_DB, rec.FAMILY)
+		if err == nil {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "refresh token is already used")
+			return
+		}
+	}
+	if err != nil {
+		log.Println("ERROR:", err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "unable to process refresh token")
+		return
+	}
+
+	// requested scope may narrow down original scope
+	scope := rec.SCOPE
+	if rscope := r.FormValue("scope"); rscope != "" {
+		granted := scopes(rec.SCOPE)
+		for _, s := range scopes(rscope) {
+			if !utils.InList(s, granted) {
+				oauthError(c, http.StatusBadRequest, "invalid_scope", fmt.Sprintf("scope %s was not granted", s))
+				return
+			}
+		}
+		scope = rscope
+	}
+	rec.SCOPE = scope
+	// requested audience may narrow down original audience
+	audience, err := narrowAudience(requestAudience(r), strings.Fields(rec.AUD))
+	if err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_target", err.Error())
+		return
+	}
+	if err := checkRefreshUser(rec); err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	tmap, err := realmTokenMap(rec.LOGIN, rec.REALM, scope, rec.KIND, "Authz", 0, audience...)
+	if err != nil {
+		log.Println("ERROR:", err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "unable to issue access token")
+		return
+	}
+	if err := addRefreshToken(&tmap, rec.FAMILY, rec.LOGIN, rec.CLIENT, scope, rec.KIND); err != nil {
+		log.Println("ERROR:", err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "unable to issue refresh token")
+		return
+	}
+	auditIssued(r, tmap, rec.LOGIN, rec.CLIENT, scope, "refresh_token")
+	c.JSON(http.StatusOK, tmap)
+}
@@ -0,0 +1,118 @@
+package main
+
+// refresh token tests
+//
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// helper function to issue refresh token to given client
+func testRefreshToken(t *testing.T, clientId string) string {
+	t.Helper()
+	tmap, err := tokenMap(testUser, "read", "device", "Authz", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addRefreshToken(&tmap, "", testUser, clientId, "read", "device"); err != nil {
+		t.Fatal(err)
+	}
+	return tmap.RefreshToken
+}
+
+// helper function to post refresh token request with given client credentials
+func refreshRequest(token, clientId, clientSecret string) *httptest.ResponseRecorder {
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {token}}
+	if clientId != "" && clientSecret == "" {
+		form.Set("client_id", clientId)
+	}
+	req := httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientSecret != "" {
+		req.SetBasicAuth(clientId, clientSecret)
+	}
+	return serve(req)
+}
+
+// TestRefreshTokenClient tests that refresh token is bound to its client
+func TestRefreshTokenClient(t *testing.T) {
+	setupKerberosTest(t)
+	confidential := ClientRecord{ClientID: "confidential"}
+	other := ClientRecord{ClientID: "other"}
+	public := ClientRecord{ClientID: "public", Public: true}
+	for _, rec := range []*ClientRecord{&confidential, &other, &public} {
+		if err := createClientRecord(_DB, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testCases := []struct {
+		name         string
+		issuedTo     string
+		clientId     string
+		clientSecret string
+		status       int
+	}{
+		{"confidential client", "confidential", "confidential", confidential.ClientSecret, http.StatusOK},
+		{"no client credentials", "confidential", "", "", http.StatusUnauthorized},
+		{"wrong client secret", "confidential", "confidential", "secret", http.StatusUnauthorized},
+		{"another client", "confidential", "other", other.ClientSecret, http.StatusUnauthorized},
+		{"public client", "public", "public", "", http.StatusOK},
+		{"public client mismatch", "public", "other", other.ClientSecret, http.StatusUnauthorized},
+		{"Authz login", "", "", "", http.StatusOK},
+		{"Authz login with client", "", "other", other.ClientSecret, http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			token := testRefreshToken(t, tc.issuedTo)
+			w := refreshRequest(token, tc.clientId, tc.clientSecret)
+			if w.Code != tc.status {
+				t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// helper function to post revocation request of given token
+func revokeRequest(token, clientId, clientSecret string) *httptest.ResponseRecorder {
+	form := url.Values{"token": {token}}
+	req := httptest.NewRequest("POST", "/oauth/revoke", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientSecret != "" {
+		req.SetBasicAuth(clientId, clientSecret)
+	}
+	return serve(req)
+}
+
+// TestRevokeRefreshToken tests that revoked refresh token can't be used by
+// refresh grant, see RFC 7009
+func TestRevokeRefreshToken(t *testing.T) {
+	setupKerberosTest(t)
+	confidential := ClientRecord{ClientID: "confidential"}
+	if err := createClientRecord(_DB, &confidential); err != nil {
+		t.Fatal(err)
+	}
+
+	// refresh token of Authz login
+	token := testRefreshToken(t, "")
+	if w := revokeRequest(token, "", ""); w.Code != http.StatusOK {
+		t.Fatalf("unexpected revoke status %d: %s", w.Code, w.Body.String())
+	}
+	if w := refreshRequest(token, "", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("revoked refresh token: unexpected status %d: %s", w.Code, w.Body.String())
+	}
+
+	// refresh token of OAuth client can only be revoked by the client
+	token = testRefreshToken(t, "confidential")
+	if w := revokeRequest(token, "", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("revoke without client: unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	if w := revokeRequest(token, "confidential", confidential.ClientSecret); w.Code != http.StatusOK {
+		t.Fatalf("unexpected revoke status %d: %s", w.Code, w.Body.String())
+	}
+	if w := refreshRequest(token, "confidential", confidential.ClientSecret); w.Code != http.StatusBadRequest {
+		t.Fatalf("revoked refresh token: unexpected status %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+// token revocation module
+//
+// revoked token IDs (jti) are kept in revoked_tokens table until
+// corresponding tokens expire, see RFC 7009
+//
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// RevokedToken represents revoked_tokens table
+type RevokedToken struct {
+	ID      uint   `json:"id"`
+	JTI     string `json:"jti"`
+	LOGIN   string `json:"login"`
+	EXPIRES int64  `json:"expires"`
+	CREATED int64  `json:"created"`
+}
+
+// isRevoked checks if given token ID is present in revoked_tokens table
+func isRevoked(db *sql.DB, jti string) (bool, error) {
+	var count int
+	query := "SELECT COUNT(*) FROM revoked_tokens WHERE jti = ?"
+	err := db.QueryRow(query, jti).Scan(&count)
+	if err != nil {
+		log.Println("ERROR: failed to query revoked token:", err)
+		return false, fmt.Errorf("[Authz.main.isRevoked] row.Scan error: %w", err)
+	}
+	return count > 0, nil
+}
+
+// revokeToken inserts given token ID into revoked_tokens table
+func revokeToken(db *sql.DB, jti, login string, expires int64) error {
+	revoked, err := isRevoked(db, jti)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return nil
+	}
+	query := "INSERT INTO revoked_tokens (jti, login, expires, created) VALUES (?, ?, ?, ?)"
+	_, err = db.Exec(query, jti, login, expires, time.Now().Unix())
+	if err != nil {
+		log.Println("ERROR: failed to revoke token:", err)
+		return fmt.Errorf("[Authz.main.revokeToken] db.Exec error: %w", err)
+	}
+	log.Printf("INFO: revoked token jti=%s login=%s", jti, login)
+	return nil
+}
+
+// cleanupRevokedTokens removes records of already expired tokens,
+// tokens revoked by their ID only (with unknown expiration) are kept
+func cleanupRevokedTokens(db *sql.DB) error {
+	query := "DELETE FROM revoked_tokens WHERE expires > 0 AND expires < ?"
+	_, err := db.Exec(query, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("[Authz.main.cleanupRevokedTokens] db.Exec error: %w", err)
+	}
+	return nil
+}
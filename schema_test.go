@@ -0,0 +1,51 @@
+package main
+
+// database schema tests
+//
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestSchemaTableNames tests that tables used by Authz queries are defined
+// with the same name in every schema, MySQL table names are case sensitive
+func TestSchemaTableNames(t *testing.T) {
+	tableRe := regexp.MustCompile(`CREATE TABLE "?(\w+)"?`)
+	schemas := make(map[string]map[string]bool)
+	for _, fname := range []string{"static/schema/mysql.sql", "static/schema/sqlite.sql"} {
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables := make(map[string]bool)
+		for _, match := range tableRe.FindAllStringSubmatch(string(data), -1) {
+			tables[match[1]] = true
+		}
+		schemas[fname] = tables
+	}
+	queryRe := regexp.MustCompile(`(?:FROM|INTO|UPDATE) (\w+)`)
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fname := range files {
+		if strings.HasSuffix(fname, "_test.go") {
+			continue
+		}
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, match := range queryRe.FindAllStringSubmatch(string(data), -1) {
+			table := match[1]
+			for schema, tables := range schemas {
+				if !tables[table] {
+					t.Errorf("%s: table %s is not defined in %s", fname, table, schema)
+				}
+			}
+		}
+	}
+}
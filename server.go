@@ -6,21 +6,20 @@ package main
 //
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"os"
+	"strings"
+	"time"
 
+	authz "github.com/CHESSComputing/golib/authz"
 	srvConfig "github.com/CHESSComputing/golib/config"
 	ldap "github.com/CHESSComputing/golib/ldap"
 	server "github.com/CHESSComputing/golib/server"
 	services "github.com/CHESSComputing/golib/services"
 	sqldb "github.com/CHESSComputing/golib/sqldb"
 	"github.com/gin-gonic/gin"
-
-	// kerberos auth
-	"gopkg.in/jcmturner/gokrb5.v7/keytab"
-	"gopkg.in/jcmturner/gokrb5.v7/service"
-	"gopkg.in/jcmturner/gokrb5.v7/spnego"
 )
 
 // examples: https://go.dev/doc/tutorial/web-service-gin
@@ -43,36 +42,89 @@ func loginHandler() gin.HandlerFunc {
 	}
 }
 
+// helper function to define handler which requires valid access token with
+// given scope. We do not rely on golib authorized routes since they only
+// validate tokens signed by shared secret, and we also check token revocation.
+// The token claims are stored in gin context under "claims" key.
+func authorized(scope string, handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := parseToken(authz.BearerToken(c.Request))
+		if err == nil {
+			if revoked, e := isRevoked(_DB, claims.ID); e != nil || revoked {
+				err = errors.New("token is revoked")
+			}
+		}
+		if err == nil && !validAudience(claims, authzAudience) {
+			err = fmt.Errorf("token audience %v does not include %s", claims.Audience, authzAudience)
+		}
+		if err != nil {
+			log.Println("ERROR: invalid token", err)
+			rec := services.Response("Authz", http.StatusUnauthorized, services.TokenError, err)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, rec)
+			return
+		}
+		if !strings.Contains(claims.CustomClaims.Scope, scope) {
+			msg := fmt.Sprintf("token scope '%s' does not match with scope '%s'", claims.CustomClaims.Scope, scope)
+			rec := services.Response("Authz", http.StatusUnauthorized, services.ScopeError, errors.New(msg))
+			c.AbortWithStatusJSON(http.StatusUnauthorized, rec)
+			return
+		}
+		c.Set("claims", claims)
+		handler(c)
+	}
+}
+
 // helper function to setup our server router
 func setupRouter() *gin.Engine {
 
 	routes := []server.Route{
-		{Method: "GET", Path: "/oauth/token", Handler: TokenHandler, Authorized: false},
-		{Method: "GET", Path: "/attrs", Handler: AttributesHandler, Authorized: true},
+		{Method: "GET", Path: "/oauth/token", Handler: instrumented("TokenHandler", rateLimited(TokenHandler)), Authorized: false},
+		{Method: "POST", Path: "/oauth/token", Handler: instrumented("TokenHandler", rateLimited(TokenHandler)), Authorized: false},
+		{Method: "GET", Path: "/attrs", Handler: authorized("read", AttributesHandler), Authorized: false},
 		//         {Method: "GET", Path: "/kauth", Handler: KAuthHandler, Authorized: false},
-		{Method: "POST", Path: "/kauth", Handler: KAuthHandler, Authorized: false},
-		{Method: "POST", Path: "/oauth/authorize", Handler: ClientAuthHandler, Authorized: false},
-		{Method: "POST", Path: "/oauth/trusted", Handler: TrustedHandler, Authorized: false},
+		{Method: "POST", Path: "/kauth", Handler: instrumented("KAuthHandler", KAuthHandler), Authorized: false},
+		{Method: "POST", Path: "/oauth/authorize", Handler: instrumented("ClientAuthHandler", rateLimited(ClientAuthHandler)), Authorized: false},
+		{Method: "POST", Path: "/oauth/ccache", Handler: instrumented("CCacheHandler", rateLimited(CCacheHandler)), Authorized: false},
+		{Method: "GET", Path: "/oauth/negotiate", Handler: instrumented("NegotiateHandler", rateLimited(negotiated(NegotiateHandler))), Authorized: false},
+		{Method: "GET", Path: "/oauth/authorize", Handler: rateLimited(AuthorizeHandler), Authorized: false},
+		{Method: "GET", Path: "/login", Handler: loginHandler(), Authorized: false},
+		{Method: "GET", Path: "/device", Handler: loginHandler(), Authorized: false},
+		{Method: "POST", Path: "/oauth/device_authorization", Handler: DeviceAuthorizationHandler, Authorized: false},
+		{Method: "POST", Path: "/authorize/check", Handler: authorized("read", AuthorizeCheckHandler), Authorized: false},
+		{Method: "GET", Path: "/elevation", Handler: ElevationPageHandler, Authorized: false},
+		{Method: "POST", Path: "/elevation", Handler: ElevationFormHandler, Authorized: false},
+		{Method: "GET", Path: "/elevations", Handler: authorized("read", ElevationsHandler), Authorized: false},
+		{Method: "POST", Path: "/elevations", Handler: authorized("read", CreateElevationHandler), Authorized: false},
+		{Method: "POST", Path: "/elevations/:id/approve", Handler: authorized("write", decideElevationHandler("approved")), Authorized: false},
+		{Method: "POST", Path: "/elevations/:id/deny", Handler: authorized("write", decideElevationHandler("denied")), Authorized: false},
+		{Method: "GET", Path: "/lockouts", Handler: authorized("read", LockoutsHandler), Authorized: false},
+		{Method: "DELETE", Path: "/lockouts/:kind/:name", Handler: authorized("write", UnlockHandler), Authorized: false},
+		{Method: "GET", Path: "/audit", Handler: authorized("read", AuditHandler), Authorized: false},
+		{Method: "GET", Path: "/audit/verify", Handler: authorized("read", AuditVerifyHandler), Authorized: false},
+		{Method: "GET", Path: "/clients", Handler: authorized("read", ClientsHandler), Authorized: false},
+		{Method: "GET", Path: "/clients/:id", Handler: authorized("read", ClientHandler), Authorized: false},
+		{Method: "POST", Path: "/clients", Handler: authorized("write", CreateClientHandler), Authorized: false},
+		{Method: "PUT", Path: "/clients/:id", Handler: authorized("write", UpdateClientHandler), Authorized: false},
+		{Method: "DELETE", Path: "/clients/:id", Handler: authorized("write", DeleteClientHandler), Authorized: false},
+		{Method: "POST", Path: "/oauth/trusted", Handler: instrumented("TrustedHandler", rateLimited(TrustedHandler)), Authorized: false},
 		{Method: "POST", Path: "/trusted_client", Handler: TrustedClientHandler, Authorized: false},
+		{Method: "POST", Path: "/oauth/revoke", Handler: RevokeHandler, Authorized: false},
+		{Method: "GET", Path: "/oauth/revoked", Handler: authorized("read", RevokedHandler), Authorized: false},
+		{Method: "POST", Path: "/oauth/introspect", Handler: IntrospectHandler, Authorized: false},
+		{Method: "GET", Path: "/.well-known/openid-configuration", Handler: OpenIDConfigurationHandler, Authorized: false},
+		{Method: "GET", Path: "/jwks.json", Handler: JWKSHandler, Authorized: false},
+		{Method: "GET", Path: "/userinfo", Handler: UserInfoHandler, Authorized: false},
+		{Method: "GET", Path: "/metrics/authz", Handler: AuthzMetricsHandler, Authorized: false},
+		{Method: "POST", Path: "/userinfo", Handler: UserInfoHandler, Authorized: false},
 	}
-	if srvConfig.Config.Kerberos.Keytab != "" {
-		kt, err := keytab.Load(srvConfig.Config.Kerberos.Keytab)
-		if err != nil {
-			log.Fatal(err)
-		}
-		l := log.New(os.Stderr, "GOKRB5 Service: ", log.Ldate|log.Ltime|log.Lshortfile)
-		h := http.HandlerFunc(LoginHandler)
-		http.Handle("/", spnego.SPNEGOKRB5Authenticate(h, kt, service.Logger(l)))
-	} else {
-		routes = append(routes,
-			server.Route{Method: "GET", Path: "/", Handler: loginHandler(), Authorized: false})
-	}
+	routes = append(routes,
+		server.Route{Method: "GET", Path: "/", Handler: loginHandler(), Authorized: false})
 	r := server.Router(routes, StaticFs, "static", srvConfig.Config.Authz.WebServer)
 	return r
 }
 
-// Server defines our HTTP server
-func Server() {
+// helper function to initialize Authz database
+func initDB() {
 	dbtype, dburi, dbowner := sqldb.ParseDBFile(srvConfig.Config.Authz.DBFile)
 	log.Printf("InitDB: type=%s owner=%s", dbtype, dbowner)
 	db, err := sqldb.InitDB(dbtype, dburi)
@@ -80,6 +132,23 @@ func Server() {
 		log.Fatal(err)
 	}
 	_DB = db
+}
+
+// helper function to periodically run given cleanup functions against Authz database
+func periodicCleanup(interval time.Duration, cleanups ...func(*sql.DB) error) {
+	for {
+		time.Sleep(interval)
+		for _, cleanup := range cleanups {
+			if err := cleanup(_DB); err != nil {
+				log.Println("ERROR:", err)
+			}
+		}
+	}
+}
+
+// Server defines our HTTP server
+func Server() {
+	initDB()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	// initialize ldap cache
@@ -95,6 +164,44 @@ func Server() {
 		_foxdenUser = &services.CHESSUser{}
 	}
 	_foxdenUser.Init()
+	// measure latency of foxden user lookups
+	_foxdenUser = &timedUserAttributes{UserAttributes: _foxdenUser}
+
+	// periodically remove expired records of Authz tables and idle rate limit buckets
+	go periodicCleanup(time.Hour,
+		cleanupRevokedTokens,
+		cleanupRefreshTokens,
+		cleanupCodes,
+		cleanupDeviceCodes,
+		expireElevations,
+		cleanupLoginFailures,
+		cleanupTrustedNonces,
+		cleanupKerberosReplays,
+		func(*sql.DB) error {
+			_rateLimiter.cleanup(time.Hour)
+			return nil
+		})
+
+	// initialize scope policy
+	if err := initPolicy(); err != nil {
+		log.Fatal(err)
+	}
+
+	// load keytab of Authz service used by SPNEGO authentication
+	if err := initKeytab(); err != nil {
+		log.Fatal(err)
+	}
+
+	// initialize keyring of token signing keys
+	if err := initKeyring(); err != nil {
+		log.Fatal(err)
+	}
+	if _config.KeyRotation > 0 {
+		go keyRotation(time.Hour)
+	}
+
+	// initialize OAuth server for authorization code flow
+	initOAuthServer()
 
 	// setup web router and start the service
 	r := setupRouter()
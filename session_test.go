@@ -0,0 +1,56 @@
+package main
+
+// session cookie tests
+//
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authz "github.com/CHESSComputing/golib/authz"
+	srvConfig "github.com/CHESSComputing/golib/config"
+)
+
+// TestSessionToken tests that session token of auth-session cookie is only
+// accepted as user session and not as access token
+func TestSessionToken(t *testing.T) {
+	setupKerberosTest(t)
+	cookie := kauth(t, testUser, testPassword)
+	if cookie == nil {
+		t.Fatal("password login did not create user session")
+	}
+
+	req := httptest.NewRequest("GET", "/oauth/authorize", nil)
+	req.AddCookie(cookie)
+	if user, err := sessionUser(req); err != nil || user != testUser {
+		t.Fatalf("unexpected session user %s: %v", user, err)
+	}
+
+	// session token is not accepted by Authz end-points and FOXDEN services
+	req = httptest.NewRequest("GET", "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+	if w := serve(req); w.Code != http.StatusUnauthorized {
+		t.Errorf("userinfo with session token: unexpected status %d", w.Code)
+	}
+	var subject DelegatedClaims
+	if err := parseClaims(cookie.Value, &subject); err == nil {
+		t.Error("session token is accepted as subject token")
+	}
+	if _, err := authz.TokenClaims(cookie.Value, srvConfig.Config.Authz.ClientID); err == nil {
+		t.Error("session token is accepted by FOXDEN services")
+	}
+
+	// session tokens signed by access token key are rejected as well
+	tmap, err := newAccessToken(authz.AuthUser{Name: testUser, Kind: sessionKind, App: "Authz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseToken(tmap.AccessToken); err == nil {
+		t.Error("session token signed by access token key is accepted")
+	}
+	req = httptest.NewRequest("GET", "/oauth/authorize", nil)
+	req.AddCookie(&http.Cookie{Name: "auth-session", Value: tmap.AccessToken})
+	if _, err := sessionUser(req); err == nil {
+		t.Error("session cookie signed by access token key is accepted")
+	}
+}
@@ -1,4 +1,4 @@
-CREATE TABLE USERS (
+CREATE TABLE users (
     ID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
     LOGIN VARCHAR(200) NOT NULL UNIQUE,
     FIRST_NAME TEXT,
@@ -8,3 +8,120 @@ CREATE TABLE USERS (
     CREATE_AT INT,
     UPDATE_AT INT
 ) ENGINE=InnoDB;
+
+CREATE TABLE clients (
+    ID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    CLIENT_ID VARCHAR(200) NOT NULL UNIQUE,
+    SECRET VARCHAR(200),
+    GRANT_TYPES TEXT,
+    SCOPES TEXT,
+    REDIRECT_URIS TEXT,
+    AUDIENCES TEXT,
+    RATE_LIMIT DOUBLE DEFAULT 0,
+    RATE_BURST INT DEFAULT 0,
+    OWNER VARCHAR(200),
+    CREATED BIGINT,
+    UPDATED BIGINT
+) ENGINE=InnoDB;
+
+CREATE TABLE revoked_tokens (
+    ID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    JTI VARCHAR(200) NOT NULL UNIQUE,
+    LOGIN VARCHAR(200),
+    EXPIRES BIGINT,
+    CREATED BIGINT
+) ENGINE=InnoDB;
+
+CREATE TABLE refresh_tokens (
+    ID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    TOKEN VARCHAR(200) NOT NULL UNIQUE,
+    FAMILY VARCHAR(200) NOT NULL,
+    LOGIN VARCHAR(200) NOT NULL,
+    CLIENT_ID VARCHAR(200),
+    SCOPE TEXT,
+    KIND VARCHAR(200),
+    JTI VARCHAR(200),
+    JTI_EXPIRES BIGINT,
+    AUDIENCE TEXT,
+    REALM VARCHAR(200),
+    USED BOOL DEFAULT 0,
+    REVOKED BOOL DEFAULT 0,
+    EXPIRES BIGINT,
+    CREATED BIGINT,
+    INDEX (FAMILY)
+) ENGINE=InnoDB;
+
+CREATE TABLE oauth_codes (
+    ID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    CODE VARCHAR(200) NOT NULL UNIQUE,
+    DATA TEXT NOT NULL,
+    EXPIRES BIGINT,
+    CREATED BIGINT
+) ENGINE=InnoDB;
+
+CREATE TABLE device_codes (
+    ID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    DEVICE_CODE VARCHAR(200) NOT NULL UNIQUE,
+    USER_CODE VARCHAR(200) NOT NULL UNIQUE,
+    CLIENT_ID VARCHAR(200) NOT NULL,
+    SCOPE TEXT,
+    STATUS VARCHAR(200) NOT NULL,
+    LOGIN VARCHAR(200),
+    POLL_INTERVAL BIGINT,
+    LAST_POLL BIGINT,
+    EXPIRES BIGINT,
+    CREATED BIGINT
+) ENGINE=InnoDB;
+
+CREATE TABLE elevations (
+    ID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    LOGIN VARCHAR(200) NOT NULL,
+    SCOPE TEXT NOT NULL,
+    REASON TEXT,
+    DURATION BIGINT,
+    STATUS VARCHAR(200) NOT NULL,
+    APPROVER VARCHAR(200),
+    DECIDED BIGINT,
+    EXPIRES BIGINT,
+    CREATED BIGINT
+) ENGINE=InnoDB;
+
+CREATE TABLE audit_log (
+    ID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    EVENT VARCHAR(200) NOT NULL,
+    OUTCOME VARCHAR(200) NOT NULL,
+    LOGIN VARCHAR(200),
+    CLIENT_ID VARCHAR(200),
+    IP VARCHAR(200),
+    SCOPE TEXT,
+    KIND VARCHAR(200),
+    REASON TEXT,
+    TOKEN_ID VARCHAR(200),
+    CREATED BIGINT,
+    PREV_HASH VARCHAR(200) NOT NULL UNIQUE,
+    HASH VARCHAR(200) NOT NULL
+) ENGINE=InnoDB;
+
+CREATE TABLE login_failures (
+    ID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    KIND VARCHAR(20) NOT NULL,
+    NAME VARCHAR(200) NOT NULL,
+    FAILURES INT DEFAULT 0,
+    LOCKED_UNTIL BIGINT DEFAULT 0,
+    UPDATED BIGINT,
+    UNIQUE KEY LOGIN_FAILURES_KIND_NAME (KIND, NAME)
+) ENGINE=InnoDB;
+
+CREATE TABLE trusted_nonces (
+    ID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    NONCE VARCHAR(200) NOT NULL UNIQUE,
+    EXPIRES BIGINT,
+    CREATED BIGINT
+) ENGINE=InnoDB;
+
+CREATE TABLE kerberos_replays (
+    ID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    AUTHENTICATOR VARCHAR(700) NOT NULL UNIQUE,
+    EXPIRES BIGINT,
+    CREATED BIGINT
+) ENGINE=InnoDB;
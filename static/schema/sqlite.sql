@@ -1,8 +1,8 @@
 --------------------------------------------------------
---  DDL for Table USER
+--  DDL for Table user
 --------------------------------------------------------
 
-CREATE TABLE "USERS" (
+CREATE TABLE "users" (
     "ID" INTEGER PRIMARY KEY,
     "LOGIN" VARCHAR2(700) NOT NULL UNIQUE,
     "FIRST_NAME" VARCHAR2(700),
@@ -12,3 +12,160 @@ CREATE TABLE "USERS" (
     "CREATED" INTEGER,
     "UPDATED" INTEGER
 );
+
+--------------------------------------------------------
+--  DDL for Table clients
+--------------------------------------------------------
+
+CREATE TABLE "clients" (
+    "ID" INTEGER PRIMARY KEY,
+    "CLIENT_ID" VARCHAR2(700) NOT NULL UNIQUE,
+    "SECRET" VARCHAR2(700),
+    "GRANT_TYPES" VARCHAR2(700),
+    "SCOPES" VARCHAR2(700),
+    "REDIRECT_URIS" TEXT,
+    "AUDIENCES" TEXT,
+    "RATE_LIMIT" REAL DEFAULT 0,
+    "RATE_BURST" INTEGER DEFAULT 0,
+    "OWNER" VARCHAR2(700),
+    "CREATED" INTEGER,
+    "UPDATED" INTEGER
+);
+
+--------------------------------------------------------
+--  DDL for Table revoked_tokens
+--------------------------------------------------------
+
+CREATE TABLE "revoked_tokens" (
+    "ID" INTEGER PRIMARY KEY,
+    "JTI" VARCHAR2(700) NOT NULL UNIQUE,
+    "LOGIN" VARCHAR2(700),
+    "EXPIRES" INTEGER,
+    "CREATED" INTEGER
+);
+
+--------------------------------------------------------
+--  DDL for Table refresh_tokens
+--------------------------------------------------------
+
+CREATE TABLE "refresh_tokens" (
+    "ID" INTEGER PRIMARY KEY,
+    "TOKEN" VARCHAR2(700) NOT NULL UNIQUE,
+    "FAMILY" VARCHAR2(700) NOT NULL,
+    "LOGIN" VARCHAR2(700) NOT NULL,
+    "CLIENT_ID" VARCHAR2(700),
+    "SCOPE" VARCHAR2(700),
+    "KIND" VARCHAR2(700),
+    "JTI" VARCHAR2(700),
+    "JTI_EXPIRES" INTEGER,
+    "AUDIENCE" TEXT,
+    "REALM" VARCHAR2(700),
+    "USED" INTEGER DEFAULT 0,
+    "REVOKED" INTEGER DEFAULT 0,
+    "EXPIRES" INTEGER,
+    "CREATED" INTEGER
+);
+CREATE INDEX "refresh_tokens_family" ON "refresh_tokens" ("FAMILY");
+
+--------------------------------------------------------
+--  DDL for Table oauth_codes
+--------------------------------------------------------
+
+CREATE TABLE "oauth_codes" (
+    "ID" INTEGER PRIMARY KEY,
+    "CODE" VARCHAR2(700) NOT NULL UNIQUE,
+    "DATA" TEXT NOT NULL,
+    "EXPIRES" INTEGER,
+    "CREATED" INTEGER
+);
+
+--------------------------------------------------------
+--  DDL for Table device_codes
+--------------------------------------------------------
+
+CREATE TABLE "device_codes" (
+    "ID" INTEGER PRIMARY KEY,
+    "DEVICE_CODE" VARCHAR2(700) NOT NULL UNIQUE,
+    "USER_CODE" VARCHAR2(700) NOT NULL UNIQUE,
+    "CLIENT_ID" VARCHAR2(700) NOT NULL,
+    "SCOPE" VARCHAR2(700),
+    "STATUS" VARCHAR2(700) NOT NULL,
+    "LOGIN" VARCHAR2(700),
+    "POLL_INTERVAL" INTEGER,
+    "LAST_POLL" INTEGER,
+    "EXPIRES" INTEGER,
+    "CREATED" INTEGER
+);
+
+--------------------------------------------------------
+--  DDL for Table elevations
+--------------------------------------------------------
+
+CREATE TABLE "elevations" (
+    "ID" INTEGER PRIMARY KEY,
+    "LOGIN" VARCHAR2(700) NOT NULL,
+    "SCOPE" VARCHAR2(700) NOT NULL,
+    "REASON" TEXT,
+    "DURATION" INTEGER,
+    "STATUS" VARCHAR2(700) NOT NULL,
+    "APPROVER" VARCHAR2(700),
+    "DECIDED" INTEGER,
+    "EXPIRES" INTEGER,
+    "CREATED" INTEGER
+);
+
+--------------------------------------------------------
+--  DDL for Table audit_log
+--------------------------------------------------------
+
+CREATE TABLE "audit_log" (
+    "ID" INTEGER PRIMARY KEY,
+    "EVENT" VARCHAR2(700) NOT NULL,
+    "OUTCOME" VARCHAR2(700) NOT NULL,
+    "LOGIN" VARCHAR2(700),
+    "CLIENT_ID" VARCHAR2(700),
+    "IP" VARCHAR2(700),
+    "SCOPE" VARCHAR2(700),
+    "KIND" VARCHAR2(700),
+    "REASON" TEXT,
+    "TOKEN_ID" VARCHAR2(700),
+    "CREATED" INTEGER,
+    "PREV_HASH" VARCHAR2(700) NOT NULL UNIQUE,
+    "HASH" VARCHAR2(700) NOT NULL
+);
+
+--------------------------------------------------------
+--  DDL for Table login_failures
+--------------------------------------------------------
+
+CREATE TABLE "login_failures" (
+    "ID" INTEGER PRIMARY KEY,
+    "KIND" VARCHAR2(700) NOT NULL,
+    "NAME" VARCHAR2(700) NOT NULL,
+    "FAILURES" INTEGER DEFAULT 0,
+    "LOCKED_UNTIL" INTEGER DEFAULT 0,
+    "UPDATED" INTEGER,
+    UNIQUE ("KIND", "NAME")
+);
+
+--------------------------------------------------------
+--  DDL for Table trusted_nonces
+--------------------------------------------------------
+
+CREATE TABLE "trusted_nonces" (
+    "ID" INTEGER PRIMARY KEY,
+    "NONCE" VARCHAR2(700) NOT NULL UNIQUE,
+    "EXPIRES" INTEGER,
+    "CREATED" INTEGER
+);
+
+--------------------------------------------------------
+--  DDL for Table kerberos_replays
+--------------------------------------------------------
+
+CREATE TABLE "kerberos_replays" (
+    "ID" INTEGER PRIMARY KEY,
+    "AUTHENTICATOR" VARCHAR2(700) NOT NULL UNIQUE,
+    "EXPIRES" INTEGER,
+    "CREATED" INTEGER
+);
@@ -0,0 +1,196 @@
+package main
+
+// token module
+//
+// Authz mints its own JWT access tokens (instead of relying on
+// authz.AuthUser.TokenMap) to assign every token an unique token ID (jti)
+// which is used by token revocation and introspection.
+// Tokens remain compatible with authz.TokenClaims used by FOXDEN services,
+// and they are signed either by shared secret (HS512) or by keyring keys
+// if Authz.SigningAlg is set. Session tokens of auth-session cookie are
+// signed by separate key and they are never accepted as access tokens.
+//
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	authz "github.com/CHESSComputing/golib/authz"
+	srvConfig "github.com/CHESSComputing/golib/config"
+	jwt "github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+// TokenMap represents token response of Authz service, it extends
+// authz.TokenMap with optional refresh and id tokens
+type TokenMap struct {
+	authz.TokenMap
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	// issued token type of token exchange response
+	IssuedTokenType string   `json:"issued_token_type,omitempty"`
+	TokenID         string   `json:"-"` // access token ID (jti)
+	Audience        []string `json:"-"` // audience of access token
+	Realm           string   `json:"-"` // Kerberos realm of the user
+}
+
+// RealmClaims represents access token claims, it extends authz.Claims with
+// Kerberos realm of the user
+type RealmClaims struct {
+	authz.Claims
+	Realm string `json:"realm,omitempty"`
+}
+
+// helper function to generate new token ID
+func newTokenID() string {
+	tid := uuid.New()
+	return hex.EncodeToString(tid[:])
+}
+
+// helper function to build access token claims for given authenticated user
+func accessTokenClaims(auser authz.AuthUser) authz.Claims {
+	now := time.Now()
+	claims := authz.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "CHESS Authz server",
+			Subject:   auser.Name,
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(auser.Expires) * time.Second)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        newTokenID(),
+		},
+		CustomClaims: authz.CustomClaims{
+			User:        auser.Name,
+			Scope:       auser.Scope,
+			Kind:        auser.Kind,
+			Application: auser.App,
+			Btrs:        auser.Btrs,
+			Groups:      auser.Groups,
+			Scopes:      auser.Scopes,
+		},
+	}
+	return claims
+}
+
+// helper function to sign access token claims either by keyring key or by shared secret
+func signAccessToken(claims jwt.Claims) (string, error) {
+	if _config.SigningAlg != "" {
+		return signToken(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
+	accessToken, err := token.SignedString([]byte(srvConfig.Config.Authz.ClientID))
+	if err != nil {
+		return "", fmt.Errorf("[Authz.main.signAccessToken] token.SignedString error: %w", err)
+	}
+	return accessToken, nil
+}
+
+// helper function to generate JWT access token for given authenticated user
+// and optional token audience
+func newAccessToken(auser authz.AuthUser, audience ...string) (TokenMap, error) {
+	return newRealmAccessToken(auser, "", audience...)
+}
+
+// helper function to generate JWT access token for given user authenticated
+// in Kerberos realm and optional token audience
+func newRealmAccessToken(auser authz.AuthUser, realm string, audience ...string) (TokenMap, error) {
+	if auser.Expires == 0 {
+		auser.Expires = 3600
+	}
+	claims := RealmClaims{Claims: accessTokenClaims(auser), Realm: realm}
+	if len(audience) > 0 {
+		claims.Audience = jwt.ClaimStrings(audience)
+	}
+	accessToken, err := signAccessToken(claims)
+	if err != nil {
+		return TokenMap{}, err
+	}
+	tmap := TokenMap{
+		TokenMap: authz.TokenMap{
+			AccessToken: accessToken,
+			Scope:       auser.Scope,
+			Type:        "bearer",
+			Expires:     auser.Expires,
+		},
+		TokenID:  claims.ID,
+		Audience: audience,
+		Realm:    realm,
+	}
+	return tmap, nil
+}
+
+// helper function to parse and validate access token into given claims.
+// Tokens signed by keyring keys are validated by their kid header, while HS512
+// tokens are only accepted if Authz does not use asymmetric signing.
+func parseClaims(accessToken string, claims jwt.Claims) error {
+	tkn, err := jwt.ParseWithClaims(accessToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+			if _config.SigningAlg != "" {
+				return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+			}
+			return []byte(srvConfig.Config.Authz.ClientID), nil
+		}
+		return verificationKey(token)
+	})
+	if err != nil {
+		return fmt.Errorf("[Authz.main.parseClaims] jwt.ParseWithClaims error: %w", err)
+	}
+	if !tkn.Valid {
+		return errors.New("[Authz.main.parseClaims] invalid token")
+	}
+	// session tokens are only accepted by sessionUser
+	var session authz.Claims
+	if _, _, err := jwt.NewParser().ParseUnverified(accessToken, &session); err == nil && session.CustomClaims.Kind == sessionKind {
+		return errors.New("[Authz.main.parseClaims] session token is not an access token")
+	}
+	return nil
+}
+
+// sessionKind defines kind of session tokens of auth-session cookie
+const sessionKind = "session"
+
+// helper function to derive HS512 key of session tokens from Authz secret,
+// neither Authz nor FOXDEN services accept tokens signed by this key
+func sessionKey() []byte {
+	mac := hmac.New(sha256.New, []byte(srvConfig.Config.Authz.ClientID))
+	mac.Write([]byte("auth-session"))
+	return mac.Sum(nil)
+}
+
+// helper function to sign session token for given user
+func signSessionToken(auser authz.AuthUser) (string, error) {
+	auser.Kind = sessionKind
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, accessTokenClaims(auser))
+	sessionToken, err := token.SignedString(sessionKey())
+	if err != nil {
+		return "", fmt.Errorf("[Authz.main.signSessionToken] token.SignedString error: %w", err)
+	}
+	return sessionToken, nil
+}
+
+// helper function to parse and validate session token
+func parseSessionToken(sessionToken string) (*authz.Claims, error) {
+	claims := &authz.Claims{}
+	tkn, err := jwt.ParseWithClaims(sessionToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return sessionKey(), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("[Authz.main.parseSessionToken] jwt.ParseWithClaims error: %w", err)
+	}
+	if !tkn.Valid || claims.CustomClaims.Kind != sessionKind {
+		return nil, errors.New("[Authz.main.parseSessionToken] invalid session token")
+	}
+	return claims, nil
+}
+
+// helper function to parse and validate access token, it returns token claims
+func parseToken(accessToken string) (*authz.Claims, error) {
+	claims := &authz.Claims{}
+	err := parseClaims(accessToken, claims)
+	return claims, err
+}
@@ -0,0 +1,34 @@
+package main
+
+// token tests
+//
+import (
+	"testing"
+
+	srvConfig "github.com/CHESSComputing/golib/config"
+)
+
+// TestTokenExpires tests that explicit token expiration, e.g. limited by
+// Kerberos ticket or scope elevation, is kept when Authz.TokenExpires is not
+// set, and default lifetime is used otherwise
+func TestTokenExpires(t *testing.T) {
+	setupKerberosTest(t)
+	for _, tc := range []struct {
+		configured, expires, expected int64
+	}{
+		{0, 300, 300},
+		{0, 0, 7200},
+		{3600, 300, 300},
+		{3600, 0, 3600},
+	} {
+		srvConfig.Config.Authz.TokenExpires = tc.configured
+		tmap, err := tokenMap(testUser, "read", "kerberos", "Authz", tc.expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tmap.Expires != tc.expected {
+			t.Errorf("TokenExpires=%d expires=%d: token expires in %d seconds, expected %d",
+				tc.configured, tc.expires, tmap.Expires, tc.expected)
+		}
+	}
+}
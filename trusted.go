@@ -0,0 +1,121 @@
+package main
+
+// trusted client replay protection module
+//
+// Trusted clients send encrypted payload with their user, IP and MAC
+// addresses to POST /oauth/trusted end-point. To prevent replay of captured
+// payloads the payload carries timestamp and random nonce, e.g.
+//
+// {"user": "...", "ip_addresses": [...], "mac_addresses": [...],
+//  "timestamp": 1700000000, "nonce": "..."}
+//
+// The server rejects payloads whose timestamp is outside of allowed window
+// (Authz.TrustedClientWindow) and payloads with already seen nonce. Nonces
+// are kept in trusted_nonces table shared by Authz replicas until their
+// payload expires. Old clients which do not provide timestamp and nonce are
+// accepted with deprecation warning in audit log unless
+// Authz.TrustedClientStrict is set. The golib utils.TrustedClient does not
+// carry timestamp and nonce, clients should add them to its JSON payload.
+//
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	srvConfig "github.com/CHESSComputing/golib/config"
+	utils "github.com/CHESSComputing/golib/utils"
+	"github.com/vkuznet/cryptoutils"
+)
+
+// trustedClientWindow defines default window of trusted payload timestamp in seconds
+const trustedClientWindow = 300
+
+// maxNonceLength defines maximum length of trusted payload nonce
+const maxNonceLength = 128
+
+// errTrustedReplay is returned when trusted payload is replayed
+var errTrustedReplay = errors.New("trusted client payload is already used")
+
+// TrustedPayload represents trusted client payload, it extends golib
+// utils.TrustedClient with timestamp and nonce
+type TrustedPayload struct {
+	utils.TrustedClient
+	Timestamp int64  `json:"timestamp"` // unix time of the payload
+	Nonce     string `json:"nonce"`     // random nonce of the payload
+}
+
+// Decrypt decrypts trusted payload
+func (t *TrustedPayload) Decrypt(edata []byte, salt string) error {
+	data, err := cryptoutils.Decrypt(edata, salt, srvConfig.Config.Encryption.Cipher)
+	if err != nil {
+		return fmt.Errorf("[Authz.main.TrustedPayload.Decrypt] cryptoutils.Decrypt error: %w", err)
+	}
+	if err := json.Unmarshal(data, t); err != nil {
+		return fmt.Errorf("[Authz.main.TrustedPayload.Decrypt] json.Unmarshal error: %w", err)
+	}
+	return nil
+}
+
+// Legacy returns true for payloads of old clients without timestamp and nonce
+func (t *TrustedPayload) Legacy() bool {
+	return t.Timestamp == 0 && t.Nonce == ""
+}
+
+// helper function to return window of trusted payload timestamp
+func trustedWindow() int64 {
+	if _config.TrustedClientWindow > 0 {
+		return _config.TrustedClientWindow
+	}
+	return trustedClientWindow
+}
+
+// helper function to record nonce of trusted payload, it returns
+// errTrustedReplay if nonce is already used
+func addTrustedNonce(db *sql.DB, nonce string, expires int64) error {
+	err := addReplayKey(db, "trusted_nonces", "nonce", nonce, expires)
+	if errors.Is(err, errReplayKey) {
+		return errTrustedReplay
+	}
+	return err
+}
+
+// helper function to check trusted payload against replay, legacy payloads
+// are accepted with deprecation warning in audit log unless strict mode is used
+func checkTrustedPayload(r *http.Request, t *TrustedPayload) error {
+	if t.Legacy() {
+		if _config.TrustedClientStrict {
+			return errors.New("trusted client payload without timestamp and nonce is not allowed")
+		}
+		log.Printf("WARNING: deprecated trusted client payload of user %s from %s", t.User, getIP(r))
+		audit(r, AuditRecord{
+			EVENT:   auditTrusted,
+			OUTCOME: "warn",
+			LOGIN:   t.User,
+			KIND:    "trusted_client",
+			REASON:  "deprecated trusted client payload without timestamp and nonce",
+		})
+		return nil
+	}
+	if t.Nonce == "" || len(t.Nonce) > maxNonceLength {
+		return errors.New("invalid trusted client payload nonce")
+	}
+	window := trustedWindow()
+	now := time.Now().Unix()
+	if t.Timestamp < now-window || t.Timestamp > now+window {
+		return fmt.Errorf("trusted client payload timestamp is outside of %d seconds window", window)
+	}
+	// nonce should be kept as long as its payload is acceptable
+	return addTrustedNonce(_DB, t.Nonce, t.Timestamp+window)
+}
+
+// helper function to remove expired nonces of trusted payloads
+func cleanupTrustedNonces(db *sql.DB) error {
+	if _, err := db.Exec("DELETE FROM trusted_nonces WHERE expires < ?", time.Now().Unix()); err != nil {
+		return fmt.Errorf("[Authz.main.cleanupTrustedNonces] db.Exec error: %w", err)
+	}
+	return nil
+}
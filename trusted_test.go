@@ -0,0 +1,88 @@
+package main
+
+// trusted client tests
+//
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	srvConfig "github.com/CHESSComputing/golib/config"
+	utils "github.com/CHESSComputing/golib/utils"
+	"github.com/vkuznet/cryptoutils"
+)
+
+// test addresses of trusted client, the IP is remote address of httptest requests
+const (
+	testTrustedIP  = "192.0.2.1"
+	testTrustedMAC = "00:11:22:33:44:55"
+)
+
+// helper function to setup trusted user and return encrypted payload as
+// trusted client would build it
+func testTrustedPayload(t *testing.T) []byte {
+	t.Helper()
+	srvConfig.Config.Encryption.Secret = "trusted-client-secret"
+	srvConfig.Config.Encryption.Cipher = "aes"
+	srvConfig.Config.TrustedUsers = []srvConfig.TrustedUser{
+		{User: testUser, IP: testTrustedIP, MAC: testTrustedMAC},
+	}
+	// trusted users obtain read+write scope
+	_policy = ScopePolicy{Scopes: map[string]ScopeRule{}}
+
+	nonce, err := randomToken(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := TrustedPayload{
+		TrustedClient: utils.TrustedClient{
+			User: testUser,
+			IPs:  []string{testTrustedIP},
+			MACs: []utils.MacAddressRecord{{Name: "eth0", Address: testTrustedMAC}},
+		},
+		Timestamp: time.Now().Unix(),
+		Nonce:     nonce,
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edata, err := cryptoutils.Encrypt(data, srvConfig.Config.Encryption.Secret, srvConfig.Config.Encryption.Cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return edata
+}
+
+// helper function to post encrypted trusted payload
+func postTrusted(edata []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/oauth/trusted", bytes.NewReader(edata))
+	return serve(req)
+}
+
+// TestTrustedReplay tests that replayed trusted payload is rejected
+func TestTrustedReplay(t *testing.T) {
+	setupKerberosTest(t)
+	edata := testTrustedPayload(t)
+	if w := postTrusted(edata); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	if w := postTrusted(edata); w.Code != http.StatusUnauthorized {
+		t.Fatalf("replayed payload: unexpected status %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestTrustedLoopback tests that requests from loopback address are subject
+// to IP check of trusted users
+func TestTrustedLoopback(t *testing.T) {
+	setupKerberosTest(t)
+	edata := testTrustedPayload(t)
+	req := httptest.NewRequest("POST", "/oauth/trusted", bytes.NewReader(edata))
+	req.RemoteAddr = "[::1]:12345"
+	if w := serve(req); w.Code != http.StatusBadRequest {
+		t.Fatalf("loopback request: unexpected status %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -1,30 +1,169 @@
 package main
 
 import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
 	"strings"
+	"time"
 )
 
-func getIP(r *http.Request) string {
-	// Check if the request was forwarded by a proxy (e.g. X-Forwarded-For header)
-	// This is useful when behind a load balancer or reverse proxy
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		ip = r.Header.Get("X-Real-Ip")
+// _trustedProxies holds networks of trusted reverse proxies
+var _trustedProxies []*net.IPNet
+
+// helper function to parse trusted proxies given either as CIDRs or IP addresses
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %s", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s: %w", proxy, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// helper function to check if given address belongs to trusted proxy
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range _trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to normalize forwarded node, i.e. strip quotes, brackets
+// and port, it returns empty string for unknown or obfuscated nodes
+func forwardedNode(node string) string {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	if net.ParseIP(node) == nil {
+		return ""
+	}
+	return node
+}
+
+// helper function to get chain of forwarded client addresses, the RFC 7239
+// Forwarded header takes precedence over X-Forwarded-For and X-Real-Ip ones
+func forwardedChain(r *http.Request) []string {
+	var chain []string
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				if key, val, ok := strings.Cut(strings.TrimSpace(pair), "="); ok && strings.EqualFold(key, "for") {
+					chain = append(chain, forwardedNode(val))
+				}
+			}
+		}
+		return chain
 	}
-	if ip != "" {
-		// In case of multiple IPs in the X-Forwarded-For header, take the first one
-		ips := strings.Split(ip, ",")
-		return strings.TrimSpace(ips[0])
+	if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		for _, node := range strings.Split(strings.Join(values, ","), ",") {
+			chain = append(chain, forwardedNode(node))
+		}
+		return chain
 	}
+	if ip := r.Header.Get("X-Real-Ip"); ip != "" {
+		chain = append(chain, forwardedNode(ip))
+	}
+	return chain
+}
 
-	// Otherwise, extract the IP from RemoteAddr
+// getIP returns client IP address of HTTP request. Forwarded headers are
+// only honored when request comes from trusted proxy (Authz.TrustedProxies),
+// in which case the chain of forwarded addresses is walked from right to left
+// and the first address which does not belong to trusted proxy is the client one.
+func getIP(r *http.Request) string {
 	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		fmt.Println("Error parsing RemoteAddr:", err)
+		log.Println("ERROR: unable to parse RemoteAddr:", err)
 		return ""
 	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+	chain := forwardedChain(r)
+	for i := len(chain) - 1; i >= 0; i-- {
+		// stop at invalid address since we can't trust anything before it
+		if chain[i] == "" {
+			break
+		}
+		ip = chain[i]
+		if !trustedProxy(ip) {
+			break
+		}
+	}
 	return ip
 }
+
+// helper function to get client credentials from HTTP request, client
+// credentials can be provided either via HTTP Basic auth or via
+// client_id/client_secret request parameters, see RFC 6749 section 2.3.1
+func clientCredentials(r *http.Request) (string, string) {
+	if clientId, clientSecret, ok := r.BasicAuth(); ok {
+		return clientId, clientSecret
+	}
+	return r.FormValue("client_id"), r.FormValue("client_secret")
+}
+
+// helper function to compare secrets in constant time
+func equalSecrets(s1, s2 string) bool {
+	return subtle.ConstantTimeCompare([]byte(s1), []byte(s2)) == 1
+}
+
+// helper function to split scope string into list of scopes, we accept
+// scopes separated by space (RFC 6749), plus or comma
+func scopes(scope string) []string {
+	return strings.FieldsFunc(scope, func(r rune) bool {
+		return r == ' ' || r == '+' || r == ','
+	})
+}
+
+// errReplayKey is returned when replay key is already recorded
+var errReplayKey = errors.New("replay key is already used")
+
+// helper function to record replay key (e.g. nonce or authenticator) in given
+// table shared by Authz replicas, the UNIQUE constraint of key column makes
+// concurrent requests with the same key fail with errReplayKey
+func addReplayKey(db *sql.DB, table, column, key string, expires int64) error {
+	query := fmt.Sprintf("INSERT INTO %s (%s, expires, created) VALUES (?, ?, ?)", table, column)
+	if _, err := db.Exec(query, key, expires, time.Now().Unix()); err != nil {
+		if uniqueViolation(err) {
+			return errReplayKey
+		}
+		return fmt.Errorf("[Authz.main.addReplayKey] db.Exec error: %w", err)
+	}
+	return nil
+}
+
+// helper function to check if database error is violation of UNIQUE
+// constraint reported by SQLite or MySQL drivers
+func uniqueViolation(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "UNIQUE constraint failed") || strings.Contains(msg, "Duplicate entry")
+}